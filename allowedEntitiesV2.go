@@ -0,0 +1,24 @@
+package tg_md2html
+
+// allowsEntity reports whether the converter's AllowedEntities include the entity type.
+func (cv ConverterV2) allowsEntity(t EntityType) bool {
+	return cv.AllowedEntities == nil || cv.AllowedEntities[t]
+}
+
+// allowNode returns the node, or only its contents if the converter doesn't allow its entity.
+func (cv ConverterV2) allowNode(n Node) []Node {
+	if t := nodeEntityType(n); t != "" && !cv.allowsEntity(t) {
+		return flattenNode(n)
+	}
+	return []Node{n}
+}
+
+// keepAsText reports whether an entity of type t should be kept as its markdown text, because it isn't allowed and the
+// converter has DisallowedAsText set. Other disallowed entities are reduced to their contents by nest.
+func (p *parserV2) keepAsText(offset int, t EntityType) bool {
+	if p.cv.allowsEntity(t) || !p.cv.DisallowedAsText {
+		return false
+	}
+	p.addDiagnostic(offset, DiagnosticDisallowedEntity, "%s is not allowed", t)
+	return true
+}
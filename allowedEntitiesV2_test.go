@@ -0,0 +1,119 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func allowedConverter(asText bool) *tg_md2html.ConverterV2 {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.AllowedEntities = map[tg_md2html.EntityType]bool{
+		tg_md2html.EntityBold:     true,
+		tg_md2html.EntityItalic:   true,
+		tg_md2html.EntityTextLink: true,
+	}
+	cv.DisallowedAsText = asText
+	return cv
+}
+
+func TestAllowedEntitiesV2(t *testing.T) {
+	for _, x := range []struct {
+		name   string
+		in     string
+		out    string
+		asText string
+	}{
+		{
+			name:   "allowed",
+			in:     "*bold* _italic_ [link](https://example.com)",
+			out:    `<b>bold</b> <i>italic</i> <a href="https://example.com">link</a>`,
+			asText: `<b>bold</b> <i>italic</i> <a href="https://example.com">link</a>`,
+		}, {
+			name:   "spoiler",
+			in:     "||secret *bold*||",
+			out:    "secret <b>bold</b>",
+			asText: "||secret <b>bold</b>||",
+		}, {
+			name:   "strikethrough",
+			in:     "~gone~ ~a _b~ c_",
+			out:    "gone a _b c_",
+			asText: "~gone~ ~a _b~ c_",
+		}, {
+			name:   "underline",
+			in:     "__under__ _line_",
+			out:    "under <i>line</i>",
+			asText: "__under__ <i>line</i>",
+		}, {
+			name:   "custom emoji",
+			in:     "![👍](tg://emoji?id=5368324170671202286)",
+			out:    "👍",
+			asText: "![👍](tg://emoji?id=5368324170671202286)",
+		}, {
+			name:   "blockquote",
+			in:     ">quoted _text_",
+			out:    "quoted <i>text</i>",
+			asText: "&gt;quoted <i>text</i>",
+		}, {
+			name:   "code",
+			in:     "`*not bold*`",
+			out:    "*not bold*",
+			asText: "`*not bold*`",
+		}, {
+			name:   "time",
+			in:     "![today](tg://time?unix=1647531900)",
+			out:    "today",
+			asText: "![today](tg://time?unix=1647531900)",
+		}, {
+			name:   "mention",
+			in:     "[someone](tg://user?id=123)",
+			out:    "someone",
+			asText: "[someone](tg://user?id=123)",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.out, allowedConverter(false).MD2HTML(x.in))
+			assert.Equal(t, x.asText, allowedConverter(true).MD2HTML(x.in))
+		})
+	}
+}
+
+func TestAllowedEntitiesV2NoLinks(t *testing.T) {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.AllowedEntities = map[tg_md2html.EntityType]bool{tg_md2html.EntityBold: true}
+
+	in := "*Buy* [now](https://spam.example.com)"
+	out, diags, err := cv.MD2HTMLStrict(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "<b>Buy</b> now", out)
+	if assert.Len(t, diags, 1) {
+		assert.Equal(t, tg_md2html.DiagnosticDisallowedEntity, diags[0].Kind)
+		assert.Equal(t, 6, diags[0].Offset)
+	}
+
+	text, entities := cv.MD2Entities(in)
+	assert.Equal(t, "Buy now", text)
+	assert.Equal(t, []tg_md2html.MessageEntity{{Type: tg_md2html.EntityBold, Offset: 0, Length: 3}}, entities)
+
+	assert.Equal(t, "Buy now", cv.StripMDV2(in))
+
+	cv.DisallowedAsText = true
+	assert.Equal(t, "Buy [now](https://spam.example.com)", cv.StripMDV2(in))
+}
+
+func TestAllowedEntitiesV2Reverse(t *testing.T) {
+	cv := allowedConverter(false)
+
+	out, err := cv.Reverse(`<b>bold</b> <tg-spoiler>secret</tg-spoiler> <code>*code*</code>`, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `*bold* secret \*code\*`, out)
+
+	out, err = cv.ReverseEntities("bold secret", []tg_md2html.MessageEntity{
+		{Type: tg_md2html.EntityBold, Offset: 0, Length: 4},
+		{Type: tg_md2html.EntitySpoiler, Offset: 5, Length: 6},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "*bold* secret", out)
+}
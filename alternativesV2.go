@@ -0,0 +1,105 @@
+package tg_md2html
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// AlternativeSeparator is a line separating alternative bodies in a single message, one of which is sent.
+const AlternativeSeparator = "%%%"
+
+func SplitAlternativesV2(in string) []string {
+	return defaultConverterV2.SplitAlternatives(in)
+}
+
+func ConvertAlternativesV2(in string) []ResultV2 {
+	return defaultConverterV2.ConvertAlternatives(in)
+}
+
+func ConvertRandomV2(in string, intn func(n int) int) ResultV2 {
+	return defaultConverterV2.ConvertRandom(in, intn)
+}
+
+// SplitAlternatives splits markdown on each AlternativeSeparator line. Separators inside code and pre blocks are kept
+// as-is. Blank alternatives are dropped.
+func (cv ConverterV2) SplitAlternatives(in string) []string {
+	code := cv.codeRanges(in)
+
+	var alts []string
+	start, offset := 0, 0 // Start of the current alternative in bytes, and of the current line in runes.
+	for lineStart := 0; lineStart <= len(in); {
+		lineEnd := strings.IndexByte(in[lineStart:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(in)
+		} else {
+			lineEnd += lineStart
+		}
+
+		line := in[lineStart:lineEnd]
+		for len(code) > 0 && code[0][1] <= offset {
+			code = code[1:]
+		}
+		if strings.TrimSpace(line) == AlternativeSeparator && (len(code) == 0 || code[0][0] > offset) {
+			alts = appendAlternative(alts, in[start:lineStart])
+			start = min(lineEnd+1, len(in))
+		}
+
+		offset += utf8.RuneCountInString(line) + 1
+		lineStart = lineEnd + 1
+	}
+	return appendAlternative(alts, in[start:])
+}
+
+func appendAlternative(alts []string, alt string) []string {
+	if strings.TrimSpace(alt) == "" {
+		return alts
+	}
+	return append(alts, alt)
+}
+
+// ConvertAlternatives converts each alternative in the markdown, as split by SplitAlternatives, with its own buttons.
+func (cv ConverterV2) ConvertAlternatives(in string) []ResultV2 {
+	alts := cv.SplitAlternatives(in)
+	res := make([]ResultV2, 0, len(alts))
+	for _, alt := range alts {
+		res = append(res, cv.Convert(alt))
+	}
+	return res
+}
+
+// ConvertRandom converts one of the alternatives in the markdown, picked with intn; eg rand.IntN from math/rand/v2.
+// intn is only called when there is more than one alternative.
+func (cv ConverterV2) ConvertRandom(in string, intn func(n int) int) ResultV2 {
+	alts := cv.SplitAlternatives(in)
+	switch len(alts) {
+	case 0:
+		return cv.Convert("")
+	case 1:
+		return cv.Convert(alts[0])
+	}
+	return cv.Convert(alts[intn(len(alts))])
+}
+
+// codeRanges returns the input offsets, in runes, covered by each code and pre entity in the markdown, in order.
+// If the input goes over the converter's Limits, it is treated as having no code.
+func (cv ConverterV2) codeRanges(in string) [][2]int {
+	p := parserV2{cv: cv, enableButtons: true, recordCode: true, delims: cv.delimiters()}
+	if !p.checkLimit(LimitInputRunes, utf8.RuneCountInString(in), cv.Limits.MaxInputRunes) {
+		return nil
+	}
+	runes, pos := escapeHTML(in)
+	p.md2html(newParseBuffer(runes, pos, cv.linkPrefixes(), &p.work))
+	if p.err != nil {
+		return nil
+	}
+	slices.SortFunc(p.codeRanges, func(a, b [2]int) int { return a[0] - b[0] })
+	return p.codeRanges
+}
+
+// addCodeRange records the input offsets covered by a code or pre entity, from start to end in the buffer.
+func (p *parserV2) addCodeRange(b *parseBuffer, start int, end int) {
+	if p.recordCode {
+		p.codeRanges = append(p.codeRanges, [2]int{b.pos[start], b.pos[end-1] + 1})
+	}
+}
@@ -0,0 +1,71 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestSplitAlternativesV2(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		in   string
+		alts []string
+	}{
+		{
+			name: "no separator",
+			in:   "Hello *there*",
+			alts: []string{"Hello *there*"},
+		}, {
+			name: "separators",
+			in:   "Hello!\n%%%\nHi <there>!\n  %%%  \nWelcome 👋",
+			alts: []string{"Hello!\n", "Hi <there>!\n", "Welcome 👋"},
+		}, {
+			name: "blank alternatives",
+			in:   "%%%\nHello\n%%%\n\n%%%",
+			alts: []string{"Hello\n"},
+		}, {
+			name: "inside code",
+			in:   "```\n%%%\n```\n%%%\n`a\n%%%\nb`\n%%%\nc",
+			alts: []string{"```\n%%%\n```\n", "`a\n%%%\nb`\n", "c"},
+		}, {
+			name: "unclosed code",
+			in:   "```\n%%%\nc",
+			alts: []string{"```\n", "c"},
+		}, {
+			name: "not a separator",
+			in:   "a %%%\n%%%%\n\\%%%",
+			alts: []string{"a %%%\n%%%%\n\\%%%"},
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.alts, tg_md2html.SplitAlternativesV2(x.in))
+		})
+	}
+}
+
+func TestConvertAlternativesV2(t *testing.T) {
+	in := "*Hello*\n[Rules](buttonurl://example.com/rules)\n%%%\n_Hi_\n[Help](buttonurl://example.com/help)"
+
+	res := tg_md2html.ConvertAlternativesV2(in)
+	if assert.Len(t, res, 2) {
+		assert.Equal(t, "<b>Hello</b>", res[0].HTML)
+		assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Rules", Type: "url", Content: "example.com/rules"}}, res[0].Buttons)
+		assert.Equal(t, "<i>Hi</i>", res[1].HTML)
+		assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Help", Type: "url", Content: "example.com/help"}}, res[1].Buttons)
+	}
+
+	picked := tg_md2html.ConvertRandomV2(in, func(n int) int {
+		assert.Equal(t, 2, n)
+		return 1
+	})
+	assert.Equal(t, res[1], picked)
+
+	single := tg_md2html.ConvertRandomV2("only one", func(int) int {
+		t.Fatal("intn should not be called for a single alternative")
+		return 0
+	})
+	assert.Equal(t, "only one", single.HTML)
+}
@@ -0,0 +1,345 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node is a single element of a parsed MarkdownV2 Document.
+type Node interface {
+	node()
+}
+
+// Document is the typed representation of some MarkdownV2 text, as returned by ConverterV2.Parse.
+type Document struct {
+	Nodes []Node
+}
+
+// Text is plain, unformatted text.
+type Text struct {
+	Value string
+}
+
+// Bold is *bold* text.
+type Bold struct {
+	Children []Node
+}
+
+// Italic is _italic_ text.
+type Italic struct {
+	Children []Node
+}
+
+// Underline is __underlined__ text.
+type Underline struct {
+	Children []Node
+}
+
+// Strike is ~strikethrough~ text.
+type Strike struct {
+	Children []Node
+}
+
+// Spoiler is ||spoiler|| text.
+type Spoiler struct {
+	Children []Node
+}
+
+// Code is `inline code`. Code contents are never parsed.
+type Code struct {
+	Value string
+}
+
+// Pre is a ```code block```, with an optional language taken from the first line.
+type Pre struct {
+	Language string
+	Value    string
+}
+
+// Link is a [text](url) link.
+type Link struct {
+	URL      string
+	Children []Node
+}
+
+// Mention is a [name](tg://user?id=123456789) mention of a user, by their ID.
+type Mention struct {
+	UserID   int64
+	Children []Node
+}
+
+// CustomEmoji is a ![👍](tg://emoji?id=5368324170671202286) premium emoji.
+type CustomEmoji struct {
+	ID       string
+	Children []Node
+}
+
+// Time is a ![22:45 tomorrow](tg://time?unix=1647531900&format=wDT) timestamp.
+type Time struct {
+	Unix     int64
+	Format   string
+	Children []Node
+}
+
+// Blockquote is a >quote, or an expandable **>quote||.
+type Blockquote struct {
+	Expandable bool
+	Children   []Node
+}
+
+// ButtonNode is a button found in the text. Buttons are not part of the rendered text.
+type ButtonNode struct {
+	ButtonV2
+}
+
+// ReplyButtonNode is a reply keyboard button found in the text. Like buttons, they are not part of the rendered text.
+type ReplyButtonNode struct {
+	ButtonV2
+}
+
+// ReplyKeyboardNode holds the reply keyboard options found in the text.
+type ReplyKeyboardNode struct {
+	ReplyKeyboardOptions
+}
+
+func (*Text) node()              {}
+func (*Bold) node()              {}
+func (*Italic) node()            {}
+func (*Underline) node()         {}
+func (*Strike) node()            {}
+func (*Spoiler) node()           {}
+func (*Code) node()              {}
+func (*Pre) node()               {}
+func (*Link) node()              {}
+func (*Mention) node()           {}
+func (*CustomEmoji) node()       {}
+func (*Time) node()              {}
+func (*Blockquote) node()        {}
+func (*ButtonNode) node()        {}
+func (*ReplyButtonNode) node()   {}
+func (*ReplyKeyboardNode) node() {}
+
+// Buttons returns all the buttons in the document, in the order they were defined.
+func (d *Document) Buttons() []ButtonV2 {
+	var btns []ButtonV2
+	walkNodes(d.Nodes, func(n Node) {
+		if b, ok := n.(*ButtonNode); ok {
+			btns = append(btns, b.ButtonV2)
+		}
+	})
+	return btns
+}
+
+// ReplyButtons returns all the reply keyboard buttons in the document, in the order they were defined.
+func (d *Document) ReplyButtons() []ButtonV2 {
+	var btns []ButtonV2
+	walkNodes(d.Nodes, func(n Node) {
+		if b, ok := n.(*ReplyButtonNode); ok {
+			btns = append(btns, b.ButtonV2)
+		}
+	})
+	return btns
+}
+
+// ReplyKeyboardOptions returns the reply keyboard options set in the document, or nil if there are none. If they are
+// set more than once, the last options are used.
+func (d *Document) ReplyKeyboardOptions() *ReplyKeyboardOptions {
+	var opts *ReplyKeyboardOptions
+	walkNodes(d.Nodes, func(n Node) {
+		if o, ok := n.(*ReplyKeyboardNode); ok {
+			opts = &o.ReplyKeyboardOptions
+		}
+	})
+	return opts
+}
+
+// Mentions returns the IDs of all the users mentioned in the document, in the order they are first mentioned.
+func (d *Document) Mentions() []int64 {
+	var ids []int64
+	walkNodes(d.Nodes, func(n Node) {
+		if m, ok := n.(*Mention); ok && !slices.Contains(ids, m.UserID) {
+			ids = append(ids, m.UserID)
+		}
+	})
+	return ids
+}
+
+// mentionURL returns the link used to mention a user.
+func mentionURL(userID int64) string {
+	return "tg://user?id=" + strconv.FormatInt(userID, 10)
+}
+
+// getMentionID returns the user ID from a tg://user link. If the link isn't a mention, ok is false; if it is, but the
+// ID isn't a valid number, err is set.
+func getMentionID(link string) (userID int64, ok bool, err error) {
+	query, ok := strings.CutPrefix(link, "tg://user?")
+	if !ok {
+		return 0, false, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return 0, true, err
+	}
+	id := values.Get("id")
+	userID, err = strconv.ParseInt(id, 10, 64)
+	if err != nil || userID <= 0 {
+		return 0, true, fmt.Errorf("user id %q is not a number", id)
+	}
+	return userID, true, nil
+}
+
+// newLink returns a Mention for tg://user links with a valid ID, and a Link for anything else.
+func newLink(link string, nested []Node) Node {
+	if userID, ok, err := getMentionID(link); ok && err == nil {
+		return &Mention{UserID: userID, Children: nested}
+	}
+	return &Link{URL: link, Children: nested}
+}
+
+// children returns the nested nodes of n, if any.
+func children(n Node) []Node {
+	switch n := n.(type) {
+	case *Bold:
+		return n.Children
+	case *Italic:
+		return n.Children
+	case *Underline:
+		return n.Children
+	case *Strike:
+		return n.Children
+	case *Spoiler:
+		return n.Children
+	case *Link:
+		return n.Children
+	case *Mention:
+		return n.Children
+	case *CustomEmoji:
+		return n.Children
+	case *Time:
+		return n.Children
+	case *SpecialLink:
+		return n.Children
+	case *Blockquote:
+		return n.Children
+	}
+	return nil
+}
+
+// walkNodes calls fn on every node, depth first.
+func walkNodes(nodes []Node, fn func(Node)) {
+	for _, n := range nodes {
+		fn(n)
+		walkNodes(children(n), fn)
+	}
+}
+
+// isHiddenNode returns whether n is one of the button or directive nodes, which aren't part of the rendered text.
+func isHiddenNode(n Node) bool {
+	switch n.(type) {
+	case *ButtonNode, *ReplyButtonNode, *ReplyKeyboardNode, *DirectiveNode:
+		return true
+	}
+	return false
+}
+
+// trimNodes removes leading and trailing whitespace from a list of nodes, as strings.TrimSpace would on the
+// rendered output.
+func trimNodes(nodes []Node) []Node {
+	for i := 0; i < len(nodes); i++ {
+		if isHiddenNode(nodes[i]) {
+			continue // Buttons and directives aren't rendered, so keep looking.
+		}
+		t, ok := nodes[i].(*Text)
+		if !ok {
+			break
+		}
+		t.Value = strings.TrimLeftFunc(t.Value, unicode.IsSpace)
+		if t.Value != "" {
+			break
+		}
+		nodes = append(nodes[:i], nodes[i+1:]...)
+		i--
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if isHiddenNode(nodes[i]) {
+			continue
+		}
+		t, ok := nodes[i].(*Text)
+		if !ok {
+			break
+		}
+		t.Value = strings.TrimRightFunc(t.Value, unicode.IsSpace)
+		if t.Value != "" {
+			break
+		}
+		nodes = append(nodes[:i], nodes[i+1:]...)
+	}
+	return nodes
+}
+
+// Render converts a parsed Document to telegram HTML.
+// Render(Parse(s)) returns the same text as MD2HTMLButtons(s).
+func (cv ConverterV2) Render(doc *Document) string {
+	out := strings.Builder{}
+	renderHTML(&out, doc.Nodes)
+	return out.String()
+}
+
+func renderHTML(out *strings.Builder, nodes []Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *Text:
+			out.WriteString(html.EscapeString(n.Value))
+		case *Bold:
+			renderHTMLTag(out, "b", "b", n.Children)
+		case *Italic:
+			renderHTMLTag(out, "i", "i", n.Children)
+		case *Underline:
+			renderHTMLTag(out, "u", "u", n.Children)
+		case *Strike:
+			renderHTMLTag(out, "s", "s", n.Children)
+		case *Spoiler:
+			renderHTMLTag(out, `span class="tg-spoiler"`, "span", n.Children)
+		case *Code:
+			out.WriteString("<code>" + html.EscapeString(n.Value) + "</code>")
+		case *Pre:
+			if n.Language != "" {
+				out.WriteString(`<pre><code class="language-` + html.EscapeString(n.Language) + `">` + html.EscapeString(n.Value) + "</code></pre>")
+			} else {
+				out.WriteString("<pre>" + html.EscapeString(n.Value) + "</pre>")
+			}
+		case *Link:
+			renderHTMLTag(out, `a href="`+html.EscapeString(n.URL)+`"`, "a", n.Children)
+		case *Mention:
+			renderHTMLTag(out, `a href="`+mentionURL(n.UserID)+`"`, "a", n.Children)
+		case *CustomEmoji, *Time, *SpecialLink:
+			h, data, nested := specialLink(n)
+			tag, attrs := h.HTML(data)
+			if attrs != "" {
+				renderHTMLTag(out, tag+" "+attrs, tag, nested)
+			} else {
+				renderHTMLTag(out, tag, tag, nested)
+			}
+		case *Blockquote:
+			if n.Expandable {
+				renderHTMLTag(out, "blockquote expandable", "blockquote", n.Children)
+			} else {
+				renderHTMLTag(out, "blockquote", "blockquote", n.Children)
+			}
+		case *ButtonNode, *ReplyButtonNode, *ReplyKeyboardNode, *DirectiveNode:
+			// Buttons and directives are returned separately; they aren't part of the text.
+		}
+	}
+}
+
+func renderHTMLTag(out *strings.Builder, open string, closing string, nodes []Node) {
+	out.WriteString("<" + open + ">")
+	renderHTML(out, nodes)
+	out.WriteString("</" + closing + ">")
+}
@@ -0,0 +1,102 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestParseV2(t *testing.T) {
+	for _, x := range []struct {
+		in  string
+		out []tg_md2html.Node
+	}{
+		{
+			in:  "hello",
+			out: []tg_md2html.Node{&tg_md2html.Text{Value: "hello"}},
+		}, {
+			in: "*bold _italic <b>_* text",
+			out: []tg_md2html.Node{
+				&tg_md2html.Bold{Children: []tg_md2html.Node{
+					&tg_md2html.Text{Value: "bold "},
+					&tg_md2html.Italic{Children: []tg_md2html.Node{&tg_md2html.Text{Value: "italic <b>"}}},
+				}},
+				&tg_md2html.Text{Value: " text"},
+			},
+		}, {
+			in: "```go\nfmt.Println(\"hi\")```",
+			out: []tg_md2html.Node{
+				&tg_md2html.Pre{Language: "go", Value: "fmt.Println(\"hi\")"},
+			},
+		}, {
+			in: "[link](example.com?a=1&b=2) `code & stuff`",
+			out: []tg_md2html.Node{
+				&tg_md2html.Link{URL: "example.com?a=1&b=2", Children: []tg_md2html.Node{&tg_md2html.Text{Value: "link"}}},
+				&tg_md2html.Text{Value: " "},
+				&tg_md2html.Code{Value: "code & stuff"},
+			},
+		}, {
+			in: "[user](tg://user?id=1234) [not a user](tg://user?id=abc)",
+			out: []tg_md2html.Node{
+				&tg_md2html.Mention{UserID: 1234, Children: []tg_md2html.Node{&tg_md2html.Text{Value: "user"}}},
+				&tg_md2html.Text{Value: " "},
+				&tg_md2html.Link{URL: "tg://user?id=abc", Children: []tg_md2html.Node{&tg_md2html.Text{Value: "not a user"}}},
+			},
+		}, {
+			in: "![👍](tg://emoji?id=5368324170671202286) ![22:45](tg://time?unix=1647531900&format=wDT)",
+			out: []tg_md2html.Node{
+				&tg_md2html.CustomEmoji{ID: "5368324170671202286", Children: []tg_md2html.Node{&tg_md2html.Text{Value: "👍"}}},
+				&tg_md2html.Text{Value: " "},
+				&tg_md2html.Time{Unix: 1647531900, Format: "wDT", Children: []tg_md2html.Node{&tg_md2html.Text{Value: "22:45"}}},
+			},
+		}, {
+			in: "**>expandable\n>quote||\n> quote",
+			out: []tg_md2html.Node{
+				&tg_md2html.Blockquote{Expandable: true, Children: []tg_md2html.Node{&tg_md2html.Text{Value: "expandable\nquote"}}},
+				&tg_md2html.Text{Value: "\n"},
+				&tg_md2html.Blockquote{Children: []tg_md2html.Node{&tg_md2html.Text{Value: "quote"}}},
+			},
+		}, {
+			in: "text [button](buttonurl://example.com)",
+			out: []tg_md2html.Node{
+				&tg_md2html.Text{Value: "text"},
+				&tg_md2html.ButtonNode{ButtonV2: tg_md2html.ButtonV2{Name: "button", Type: "url", Content: "example.com"}},
+			},
+		}, {
+			// not a valid timestamp, so kept as text.
+			in:  "![22:45](tg://time?unix=tomorrow)",
+			out: []tg_md2html.Node{&tg_md2html.Text{Value: "![22:45](tg://time?unix=tomorrow)"}},
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			doc, err := tg_md2html.NewV2(map[string]string{"url": "buttonurl"}, nil).Parse(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, doc.Nodes)
+		})
+	}
+}
+
+func TestRenderV2(t *testing.T) {
+	var inputs []string
+	for _, x := range append(append(basicMD, basicMDv2...), advancedMD...) {
+		inputs = append(inputs, x.in)
+	}
+	for _, x := range md2HTMLV2Buttons {
+		inputs = append(inputs, x.in)
+	}
+	inputs = append(inputs, reverseTest...)
+
+	for _, in := range inputs {
+		t.Run(in, func(t *testing.T) {
+			cv := testConverter()
+			doc, err := cv.Parse(in)
+			assert.NoError(t, err)
+
+			txt, btns := cv.MD2HTMLButtons(in)
+			assert.Equal(t, txt, cv.Render(doc))
+			assert.Equal(t, btns, doc.Buttons())
+		})
+	}
+}
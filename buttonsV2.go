@@ -0,0 +1,226 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Button types with built-in validation, matching telegram's inline keyboard buttons. Any other type in
+// ConverterV2.Prefixes is accepted as-is.
+// https://core.telegram.org/bots/api#inlinekeyboardbutton
+const (
+	ButtonTypeURL                          = "url"
+	ButtonTypeCallback                     = "callback"
+	ButtonTypeSwitchInlineQuery            = "switch_inline_query"
+	ButtonTypeSwitchInlineQueryCurrentChat = "switch_inline_query_current_chat"
+	ButtonTypeCopyText                     = "copy_text"
+	ButtonTypeWebApp                       = "web_app"
+	ButtonTypeLoginURL                     = "login_url"
+	ButtonTypePay                          = "pay"
+)
+
+// MaxCallbackDataLength is the maximum length of a callback button's data, in bytes.
+const MaxCallbackDataLength = 64
+
+// MaxCopyTextLength is the maximum length of a copy_text button's text, in characters.
+const MaxCopyTextLength = 256
+
+// MaxInlineQueryLength is the maximum length of the query inserted by a switch inline button, in characters.
+const MaxInlineQueryLength = 256
+
+var ErrInvalidButton = errors.New("invalid button")
+
+// InlineKeyboardButton is a button as sent to telegram, with a typed field for each kind of button.
+// Exactly one of the optional fields is set.
+type InlineKeyboardButton struct {
+	Text                         string          `json:"text"`
+	Style                        string          `json:"style,omitempty"`
+	IconCustomEmojiID            string          `json:"icon_custom_emoji_id,omitempty"`
+	URL                          string          `json:"url,omitempty"`
+	CallbackData                 string          `json:"callback_data,omitempty"`
+	SwitchInlineQuery            *string         `json:"switch_inline_query,omitempty"`
+	SwitchInlineQueryCurrentChat *string         `json:"switch_inline_query_current_chat,omitempty"`
+	CopyText                     *CopyTextButton `json:"copy_text,omitempty"`
+	WebApp                       *WebAppInfo     `json:"web_app,omitempty"`
+	LoginURL                     *LoginURL       `json:"login_url,omitempty"`
+	Pay                          bool            `json:"pay,omitempty"`
+}
+
+// CopyTextButton is the text copied to the clipboard by a copy_text button.
+type CopyTextButton struct {
+	Text string `json:"text"`
+}
+
+// WebAppInfo is the web app opened by a web_app button.
+type WebAppInfo struct {
+	URL string `json:"url"`
+}
+
+// LoginURL is the URL used to authorize the user with a login_url button.
+type LoginURL struct {
+	URL string `json:"url"`
+}
+
+// buttonNeedsContent returns whether buttons of a type must have some content. Switch inline buttons may insert an
+// empty query, poll requests default to any kind of poll, and pay and most reply buttons have no content at all.
+func buttonNeedsContent(buttonType string) bool {
+	switch buttonType {
+	case ButtonTypeSwitchInlineQuery, ButtonTypeSwitchInlineQueryCurrentChat, ButtonTypePay,
+		ReplyButtonTypeText, ReplyButtonTypeContact, ReplyButtonTypeLocation, ReplyButtonTypePoll:
+		return false
+	}
+	return true
+}
+
+// Validate checks that the button's content is accepted by telegram for its type.
+func (b ButtonV2) Validate() error {
+	// Content is kept HTML-escaped, but telegram receives it unescaped.
+	content := html.UnescapeString(b.Content)
+	if _, err := strconv.ParseUint(b.Icon, 10, 64); b.Icon != "" && err != nil {
+		return fmt.Errorf("%w: icon emoji id %q is not a number", ErrInvalidButton, b.Icon)
+	}
+
+	switch b.Type {
+	case ButtonTypeCallback:
+		if l := len(content); l < 1 || l > MaxCallbackDataLength {
+			return fmt.Errorf("%w: callback data must be 1-%d bytes, got %d", ErrInvalidButton, MaxCallbackDataLength, l)
+		}
+	case ButtonTypeSwitchInlineQuery, ButtonTypeSwitchInlineQueryCurrentChat:
+		if l := utf8.RuneCountInString(content); l > MaxInlineQueryLength {
+			return fmt.Errorf("%w: inline query must be at most %d characters, got %d", ErrInvalidButton, MaxInlineQueryLength, l)
+		}
+	case ButtonTypeCopyText:
+		if l := utf8.RuneCountInString(content); l < 1 || l > MaxCopyTextLength {
+			return fmt.Errorf("%w: copy text must be 1-%d characters, got %d", ErrInvalidButton, MaxCopyTextLength, l)
+		}
+	case ButtonTypeWebApp, ButtonTypeLoginURL:
+		if u, err := url.Parse(content); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%w: %s url must be https, got %q", ErrInvalidButton, b.Type, content)
+		}
+	case ButtonTypePay, ReplyButtonTypeText, ReplyButtonTypeContact, ReplyButtonTypeLocation:
+		if content != "" {
+			return fmt.Errorf("%w: %s buttons have no content, got %q", ErrInvalidButton, b.Type, content)
+		}
+	case ReplyButtonTypePoll:
+		if content != "" && content != PollTypeQuiz && content != PollTypeRegular {
+			return fmt.Errorf("%w: poll type must be %q or %q, got %q", ErrInvalidButton, PollTypeQuiz, PollTypeRegular, content)
+		}
+	case ReplyButtonTypeUsers:
+		if _, err := parseRequestUsers(content); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidButton, err)
+		}
+	case ReplyButtonTypeChat:
+		if _, err := parseRequestChat(content); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidButton, err)
+		}
+	}
+	return nil
+}
+
+// InlineKeyboardButton converts a parsed button to its typed form, mapping its style to the telegram value.
+func (cv ConverterV2) InlineKeyboardButton(btn ButtonV2) (InlineKeyboardButton, error) {
+	if btn.Name == "" || (btn.Content == "" && buttonNeedsContent(btn.Type)) {
+		return InlineKeyboardButton{}, ErrNoButtonContent
+	}
+	if err := btn.Validate(); err != nil {
+		return InlineKeyboardButton{}, err
+	}
+
+	style, err := cv.telegramStyle(btn.Style)
+	if err != nil {
+		return InlineKeyboardButton{}, err
+	}
+
+	ib := InlineKeyboardButton{Text: btn.Name, Style: style, IconCustomEmojiID: btn.Icon}
+	content := html.UnescapeString(btn.Content)
+	switch btn.Type {
+	case ButtonTypeURL:
+		if ib.URL, err = cv.CheckURL(content); err != nil {
+			return InlineKeyboardButton{}, err
+		}
+	case ButtonTypeCallback:
+		ib.CallbackData = content
+	case ButtonTypeSwitchInlineQuery:
+		ib.SwitchInlineQuery = &content
+	case ButtonTypeSwitchInlineQueryCurrentChat:
+		ib.SwitchInlineQueryCurrentChat = &content
+	case ButtonTypeCopyText:
+		ib.CopyText = &CopyTextButton{Text: content}
+	case ButtonTypeWebApp:
+		ib.WebApp = &WebAppInfo{URL: content}
+	case ButtonTypeLoginURL:
+		ib.LoginURL = &LoginURL{URL: content}
+	case ButtonTypePay:
+		ib.Pay = true
+	default:
+		return InlineKeyboardButton{}, fmt.Errorf("%w: %q is not an inline keyboard button type", ErrInvalidButton, btn.Type)
+	}
+	return ib, nil
+}
+
+// Button converts a typed button back to a ButtonV2, which can then be written with ButtonToMarkdown.
+func (cv ConverterV2) Button(ib InlineKeyboardButton) (ButtonV2, error) {
+	btn := ButtonV2{Name: ib.Text, Icon: ib.IconCustomEmojiID}
+	switch {
+	case ib.URL != "":
+		btn.Type, btn.Content = ButtonTypeURL, ib.URL
+	case ib.CallbackData != "":
+		btn.Type, btn.Content = ButtonTypeCallback, ib.CallbackData
+	case ib.SwitchInlineQuery != nil:
+		btn.Type, btn.Content = ButtonTypeSwitchInlineQuery, *ib.SwitchInlineQuery
+	case ib.SwitchInlineQueryCurrentChat != nil:
+		btn.Type, btn.Content = ButtonTypeSwitchInlineQueryCurrentChat, *ib.SwitchInlineQueryCurrentChat
+	case ib.CopyText != nil:
+		btn.Type, btn.Content = ButtonTypeCopyText, ib.CopyText.Text
+	case ib.WebApp != nil:
+		btn.Type, btn.Content = ButtonTypeWebApp, ib.WebApp.URL
+	case ib.LoginURL != nil:
+		btn.Type, btn.Content = ButtonTypeLoginURL, ib.LoginURL.URL
+	case ib.Pay:
+		btn.Type = ButtonTypePay
+	default:
+		return ButtonV2{}, ErrNoButtonContent
+	}
+	btn.Content = html.EscapeString(btn.Content)
+
+	style, err := cv.styleName(ib.Style)
+	if err != nil {
+		return ButtonV2{}, err
+	}
+	btn.Style = style
+	return btn, btn.Validate()
+}
+
+// telegramStyle maps a button's style name to the telegram value.
+func (cv ConverterV2) telegramStyle(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	style, ok := cv.Styles[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrInvalidButtonStyle, name)
+	}
+	return style, nil
+}
+
+// styleName maps a telegram style value back to the first style name, alphabetically, which the converter maps to it.
+func (cv ConverterV2) styleName(style string) (string, error) {
+	if style == "" {
+		return "", nil
+	}
+	names := make([]string, 0, len(cv.Styles))
+	for name, s := range cv.Styles {
+		if s == style {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrInvalidButtonStyle, style)
+	}
+	return slices.Min(names), nil
+}
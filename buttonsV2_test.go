@@ -0,0 +1,176 @@
+package tg_md2html_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestButtonV2Validate(t *testing.T) {
+	for _, x := range []struct {
+		name    string
+		btn     tg_md2html.ButtonV2
+		wantErr error
+	}{
+		{
+			name: "url",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "url", Content: "example.com"},
+		}, {
+			name: "callback",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "callback", Content: "rules_page_1"},
+		}, {
+			name: "icon",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "url", Content: "example.com", Icon: "5368324170671202286"},
+		}, {
+			name:    "icon not a number",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "url", Content: "example.com", Icon: "smile"},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name: "callback at limit",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "callback", Content: strings.Repeat("a", 64)},
+		}, {
+			name: "escaped callback at limit",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "callback", Content: strings.Repeat("&amp;", 64)},
+		}, {
+			name:    "callback too long",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "callback", Content: strings.Repeat("a", 65)},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name:    "multi-byte callback too long",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "callback", Content: strings.Repeat("é", 33)},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name:    "empty callback",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "callback"},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name: "empty inline query",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "switch_inline_query"},
+		}, {
+			name:    "inline query too long",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "switch_inline_query_current_chat", Content: strings.Repeat("a", 257)},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name: "copy text at limit",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "copy_text", Content: strings.Repeat("é", 256)},
+		}, {
+			name:    "copy text too long",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "copy_text", Content: strings.Repeat("a", 257)},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name: "web app",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "web_app", Content: "https://example.com/app?a=1&amp;b=2"},
+		}, {
+			name:    "web app without https",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "web_app", Content: "http://example.com/app"},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name:    "login url without scheme",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "login_url", Content: "example.com/login"},
+			wantErr: tg_md2html.ErrInvalidButton,
+		}, {
+			name: "pay",
+			btn:  tg_md2html.ButtonV2{Name: "test", Type: "pay"},
+		}, {
+			name:    "pay with content",
+			btn:     tg_md2html.ButtonV2{Name: "test", Type: "pay", Content: "5"},
+			wantErr: tg_md2html.ErrInvalidButton,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.ErrorIs(t, x.btn.Validate(), x.wantErr)
+		})
+	}
+}
+
+func TestMD2HTMLButtonsV2InvalidButton(t *testing.T) {
+	in := "text\n[ok](buttoncb:page_1)\n[too long](buttoncb:" + strings.Repeat("a", 65) + ")"
+	out, btns, diags, err := testConverter().MD2HTMLButtonsStrict(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "text", out)
+
+	// Invalid buttons are still returned, so they can be reported to the user.
+	if assert.Len(t, btns, 2) {
+		assert.NoError(t, btns[0].Err)
+		assert.Equal(t, "too long", btns[1].Name)
+		assert.ErrorIs(t, btns[1].Err, tg_md2html.ErrInvalidButton)
+	}
+	assert.Equal(t, []tg_md2html.Diagnostic{
+		{Offset: 27, Line: 3, Column: 1, Kind: tg_md2html.DiagnosticInvalidButton, Message: "invalid button: callback data must be 1-64 bytes, got 65"},
+	}, diags)
+}
+
+func TestInlineKeyboardButtonV2(t *testing.T) {
+	query := "find <this>"
+	for _, x := range []struct {
+		in  string
+		btn tg_md2html.InlineKeyboardButton
+	}{
+		{
+			in:  "[Site](buttonurl#primary://example.com)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Site", Style: "primary", URL: "example.com"},
+		}, {
+			in:  "[Site](buttonurl#success@5368324170671202286://example.com)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Site", Style: "success", IconCustomEmojiID: "5368324170671202286", URL: "example.com"},
+		}, {
+			in:  "[Rules](buttoncb://rules_page_1)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Rules", CallbackData: "rules_page_1"},
+		}, {
+			in:  "[Share](buttonswitch://find <this>)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Share", SwitchInlineQuery: &query},
+		}, {
+			in:  "[Search](buttonswitchhere://find <this>)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Search", SwitchInlineQueryCurrentChat: &query},
+		}, {
+			in:  "[Copy](buttoncopy://some & text)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Copy", CopyText: &tg_md2html.CopyTextButton{Text: "some & text"}},
+		}, {
+			in:  "[App](buttonwebapp://https://example.com/app?a=1&b=2)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "App", WebApp: &tg_md2html.WebAppInfo{URL: "https://example.com/app?a=1&b=2"}},
+		}, {
+			in:  "[Login](buttonlogin://https://example.com/login)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Login", LoginURL: &tg_md2html.LoginURL{URL: "https://example.com/login"}},
+		}, {
+			in:  "[Pay](buttonpay://)",
+			btn: tg_md2html.InlineKeyboardButton{Text: "Pay", Pay: true},
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			cv := testConverter()
+			out, btns, diags, err := cv.MD2HTMLButtonsStrict(x.in)
+			assert.NoError(t, err)
+			assert.Empty(t, out)
+			assert.Empty(t, diags)
+			if !assert.Len(t, btns, 1) {
+				return
+			}
+
+			ib, err := cv.InlineKeyboardButton(btns[0])
+			assert.NoError(t, err)
+			assert.Equal(t, x.btn, ib)
+
+			// Typed buttons convert back to the same markdown.
+			btn, err := cv.Button(ib)
+			assert.NoError(t, err)
+			assert.Equal(t, btns[0], btn)
+			md, err := cv.ButtonToMarkdown(btn)
+			assert.NoError(t, err)
+			assert.Equal(t, x.in, md)
+		})
+	}
+}
+
+func TestButtonPrefixesV2Default(t *testing.T) {
+	// Only URL buttons are parsed by default; the other prefixes are kept as links.
+	out, btns := tg_md2html.MD2HTMLButtonsV2("[Rules](buttoncb:rules)\n[Site](buttonurl:example.com)")
+	assert.Equal(t, `<a href="buttoncb:rules">Rules</a>`, out)
+	assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Site", Type: tg_md2html.ButtonTypeURL, Content: "example.com"}}, btns)
+
+	cv := tg_md2html.NewV2(tg_md2html.DefaultPrefixes(), nil)
+	out, btns = cv.MD2HTMLButtons("[Rules](buttoncb:rules)")
+	assert.Empty(t, out)
+	assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Rules", Type: tg_md2html.ButtonTypeCallback, Content: "rules"}}, btns)
+}
@@ -38,7 +38,6 @@ func validEnd(pos int, input []rune) bool {
 }
 
 var link = regexp.MustCompile(`a href="(.*)"`)
-var customEmoji = regexp.MustCompile(`tg-emoji emoji-id="(.*)"`)
 
 func IsEscaped(input []rune, pos int) bool {
 	if pos == 0 {
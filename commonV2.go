@@ -1,145 +1,368 @@
 package tg_md2html
 
 import (
-	"strings"
+	"unicode"
 )
 
-func hasPrefix(s string, tgPrefixes []string) bool {
-	rest, ok := strings.CutPrefix(s, "tg://")
-	if !ok {
-		return false
+// parseBuffer holds escaped input being parsed, along with lookup tables which allow delimiters to be matched without
+// rescanning the rest of the input; this keeps parsing linear in the size of the input.
+// The tables cover the whole buffer, and are built the first time they are needed. The few positions whose validity
+// depends on the edges of the window being parsed are checked directly.
+type parseBuffer struct {
+	runes []rune
+	// pos holds the offset in the original input of each rune.
+	pos []int
+
+	// backslashes holds the number of backslashes directly before each rune.
+	backslashes []int
+	// lineEnds holds the first newline at or after each rune.
+	lineEnds []int
+	// validEnds holds, for each delimiter, the first valid end at or after each rune.
+	validEnds map[string][]int
+	// runEnds holds, for each delimiter, the start of the last delimiter in the run of them continuing from each rune.
+	runEnds map[string][]int
+	// linkMids holds the first unescaped "](" at or after each rune, and prevLinkMids the last one at or before it.
+	// Index 1 only holds those followed by a special link URL, such as tg://emoji?, and index 0 only those which aren't.
+	linkMids     [2][]int
+	prevLinkMids [2][]int
+	// linkEnds holds the first unescaped ')' at or after each rune.
+	linkEnds []int
+	// failedLinks holds the problem with each tg:// link that couldn't be parsed, by the index of its "](".
+	failedLinks map[int]*linkFailure
+	// linkPrefixes holds the escaped URL prefixes of special links, and maxLinkMidLen the length of the longest "](" plus
+	// prefix checked by isLinkMid.
+	linkPrefixes  [][]rune
+	maxLinkMidLen int
+
+	// work counts the steps taken to parse the input, including building tables; it is shared by all the buffers
+	// used in a parse.
+	work *int
+}
+
+func newParseBuffer(runes []rune, pos []int, linkPrefixes [][]rune, work *int) *parseBuffer {
+	maxLinkMidLen := 0
+	for _, prefix := range linkPrefixes {
+		maxLinkMidLen = max(maxLinkMidLen, len("](")+len(prefix))
+	}
+	return &parseBuffer{runes: runes, pos: pos, linkPrefixes: linkPrefixes, maxLinkMidLen: maxLinkMidLen, work: work}
+}
+
+func (b *parseBuffer) addWork(n int) {
+	*b.work += n
+}
+
+// scanAhead is how far the parser looks for a delimiter before building a table to find it; most entities are short,
+// so this avoids building tables for most messages.
+const scanAhead = 128
+
+// isEscaped reports whether the rune at i is escaped by a backslash, ignoring any backslashes before lo.
+func (b *parseBuffer) isEscaped(lo int, i int) bool {
+	j := i - 1
+	for j >= lo && j > i-scanAhead && b.runes[j] == '\\' {
+		j--
+	}
+	b.addWork(i - j)
+	if j < lo || b.runes[j] != '\\' {
+		return (i-j)%2 == 0
 	}
 
-	for _, prefix := range tgPrefixes {
-		if strings.HasPrefix(rest, prefix) {
-			return true
+	if b.backslashes == nil {
+		b.addWork(len(b.runes))
+		b.backslashes = make([]int, len(b.runes)+1)
+		for j := 1; j <= len(b.runes); j++ {
+			if b.runes[j-1] == '\\' {
+				b.backslashes[j] = b.backslashes[j-1] + 1
+			}
 		}
 	}
-	return false
+	return min(b.backslashes[i], i-lo)%2 == 1
 }
 
-// finds the middle '](' section of in a link markdown
-func findLinkMidSectionIdx(in []rune, tgSpecial bool) int {
-	var textEnd int
-	var offset int
-	for offset < len(in) {
-		idx := stringIndex(in[offset:], "](")
-		if idx < 0 {
-			return -1
+// lineEnd returns the first newline at or after i, or the end of the buffer.
+func (b *parseBuffer) lineEnd(i int) int {
+	if b.lineEnds == nil {
+		for j := i; j < min(len(b.runes), i+scanAhead); j++ {
+			if b.runes[j] == '\n' {
+				return j
+			}
 		}
-		textEnd = offset + idx
-		if !IsEscaped(in, textEnd) {
-			prefixed := hasPrefix(string(in[textEnd+2:]), []string{"emoji?", "time?"})
-			if (prefixed && tgSpecial) || (!prefixed && !tgSpecial) {
-				return textEnd
+		b.addWork(len(b.runes))
+		b.lineEnds = make([]int, len(b.runes)+1)
+		b.lineEnds[len(b.runes)] = len(b.runes)
+		for j := len(b.runes) - 1; j >= 0; j-- {
+			b.lineEnds[j] = b.lineEnds[j+1]
+			if b.runes[j] == '\n' {
+				b.lineEnds[j] = j
 			}
 		}
-		offset = textEnd + 1
 	}
-	return -1
+	return b.lineEnds[i]
 }
 
-// finds the closing ')' section of in a link markdown
-func findLinkEndSectionIdx(in []rune) int {
-	var linkEnd int
-	var offset int
-	for offset < len(in) {
-		idx := getLinkEnd(in[offset:])
-		if idx < 0 {
-			return -1
+// isValidEnd reports whether the delimiter s at e can close an entity whose contents start at lo, inside a window
+// ending at hi.
+func (b *parseBuffer) isValidEnd(lo int, hi int, e int, s string) bool {
+	if e < lo || e+len(s) > hi || !b.isDelimiter(e, s) {
+		return false
+	}
+
+	// validEnd check has double logic to account for multi char strings
+	validEnd := func(pos int) bool {
+		if pos == lo || unicode.IsSpace(b.runes[pos-1]) {
+			return false
 		}
-		linkEnd = offset + idx
-		if !IsEscaped(in, linkEnd) {
-			return linkEnd
+		if pos == hi-1 {
+			return true
 		}
-		offset = linkEnd + 1
+		return !unicode.IsLetter(b.runes[pos+1]) && !unicode.IsDigit(b.runes[pos+1])
 	}
-	return -1
+	isCodeBlockNewlineEnd := s == "```" && (e == lo || b.runes[e-1] == '\n')
+	return (validEnd(e) || isCodeBlockNewlineEnd) && validEnd(e+len(s)-1) && !b.isEscaped(lo, e)
 }
 
-// finds the middle and closing sections of in a link markdown
-func findLinkSectionsIdx(in []rune, tgSpecial bool) (int, int) {
-	textEnd := findLinkMidSectionIdx(in, tgSpecial)
-	if textEnd < 0 {
-		return -1, -1
+// getValidEnd returns the end of an entity delimited by s, whose contents start at lo, inside a window ending at hi.
+// If there is a run of delimiters, the last one is used. Returns -1 if there is no valid end.
+func (b *parseBuffer) getValidEnd(lo int, hi int, s string) int {
+	end := b.findValidEnd(lo, hi, s)
+	if end < 0 {
+		return -1
 	}
+	return min(b.runEnd(end, s), hi-len(s))
+}
 
-	linkEnd := findLinkEndSectionIdx(in[textEnd:])
-	if linkEnd < 0 {
-		return -1, -1
-	}
-	offsetLinkEnd := textEnd + linkEnd
+// runEnd returns the start of the last delimiter s in the run of them continuing from i; eg for "*" in "a***", the
+// run from 1 ends at 3.
+func (b *parseBuffer) runEnd(i int, s string) int {
+	ends, ok := b.runEnds[s]
+	if !ok {
+		for j := i; j < i+scanAhead; j++ {
+			b.addWork(len(s))
+			if !b.isDelimiter(j+1, s) {
+				return j
+			}
+		}
 
-	// We've found the first valid "mid" section above; and we've found the "end" section too.
-	// Now, we iterate over the text in between the mid and end sections to see if any other mid sections exist.
-	// If yes, we choose those instead - it would be invalid in a URL anyway.
-	for textEnd < offsetLinkEnd {
-		newTextEnd := findLinkMidSectionIdx(in[textEnd+1:offsetLinkEnd], tgSpecial)
-		if newTextEnd == -1 {
-			break
+		b.addWork(len(b.runes))
+		ends = make([]int, len(b.runes)+1)
+		ends[len(b.runes)] = len(b.runes)
+		for j := len(b.runes) - 1; j >= 0; j-- {
+			ends[j] = j
+			if b.isDelimiter(j+1, s) {
+				ends[j] = ends[j+1]
+			}
 		}
-		textEnd = textEnd + newTextEnd + 1
+		if b.runEnds == nil {
+			b.runEnds = map[string][]int{}
+		}
+		b.runEnds[s] = ends
 	}
+	return ends[i]
+}
 
-	return textEnd, offsetLinkEnd
+// isDelimiter reports whether the delimiter s starts at i.
+func (b *parseBuffer) isDelimiter(i int, s string) bool {
+	if i+len(s) > len(b.runes) {
+		return false
+	}
+	for idx := range len(s) {
+		if b.runes[i+idx] != rune(s[idx]) {
+			return false
+		}
+	}
+	return true
 }
 
-func getLinkContents(in []rune, tgSpecial bool) (bool, []rune, string, int) {
-	// find ]( and then )
-	textEndIdx, urlEndIdx := findLinkSectionsIdx(in, tgSpecial)
-	if textEndIdx < 0 || urlEndIdx < 0 {
-		return false, nil, "", 0
+// findValidEnd returns the first valid end of an entity delimited by s, whose contents start at lo, inside a window
+// ending at hi.
+func (b *parseBuffer) findValidEnd(lo int, hi int, s string) int {
+	last := hi - len(s)
+	ends, ok := b.validEnds[s]
+	if !ok {
+		for e := lo; e <= min(last, lo+scanAhead); e++ {
+			b.addWork(len(s))
+			if b.isValidEnd(lo, hi, e, s) {
+				return e
+			}
+		}
+		if last <= lo+scanAhead {
+			return -1
+		}
+
+		b.addWork(len(b.runes))
+		ends = make([]int, len(b.runes)+1)
+		ends[len(b.runes)] = len(b.runes)
+		for e := len(b.runes) - 1; e >= 0; e-- {
+			ends[e] = ends[e+1]
+			if b.isValidEnd(0, len(b.runes), e, s) {
+				ends[e] = e
+			}
+		}
+		if b.validEnds == nil {
+			b.validEnds = map[string][]int{}
+		}
+		b.validEnds[s] = ends
+	}
+
+	// The table is only accurate away from the edges of the window; the first and last positions, and the first one
+	// after any leading backslashes, are checked separately.
+	afterBackslashes := lo
+	for afterBackslashes < hi && b.runes[afterBackslashes] == '\\' {
+		afterBackslashes++
+	}
+	b.addWork(afterBackslashes - lo + 1)
+	isEdge := func(e int) bool {
+		return e == lo || e == afterBackslashes || e == last
 	}
 
-	content := string(in[textEndIdx+2 : urlEndIdx])
-	text := in[1:textEndIdx]
-	return true, text, content, urlEndIdx + 1
+	end := -1
+	for _, e := range []int{lo, afterBackslashes, last} {
+		if (end < 0 || e < end) && b.isValidEnd(lo, hi, e, s) {
+			end = e
+		}
+	}
+	e := ends[lo]
+	for e < last && isEdge(e) {
+		e = ends[e+1]
+	}
+	if e < last && (end < 0 || e < end) {
+		end = e
+	}
+	return end
 }
 
-func isCodeBlockNewlineEnd(in []rune, offset int, item string) bool {
-	if item != "```" {
-		return false
+// isLinkMid reports whether there is an unescaped "](" at i, inside a window ending at hi, and whether it is followed by
+// a special link URL.
+func (b *parseBuffer) isLinkMid(i int, hi int) (bool, bool) {
+	if i+2 > hi || b.runes[i] != ']' || b.runes[i+1] != '(' || b.isEscaped(0, i) {
+		return false, false
+	}
+	rest := b.runes[i+2 : hi]
+	for _, prefix := range b.linkPrefixes {
+		if startsWith(rest, prefix) {
+			return true, true
+		}
 	}
-	return offset == 0 || in[offset-1] == '\n'
+	return true, false
 }
 
-func getValidEnd(in []rune, s string) int {
-	offset := 0
-	for offset < len(in) {
-		idx := stringIndex(in[offset:], s)
-		if idx < 0 {
+// findLinkMidSectionIdx finds the middle "](" section of a link, starting at lo inside a window ending at hi.
+func (b *parseBuffer) findLinkMidSectionIdx(lo int, hi int, tgSpecial bool) int {
+	special := 0
+	if tgSpecial {
+		special = 1
+	}
+	if b.linkMids[special] == nil {
+		for mid := lo; mid < min(hi, lo+scanAhead); mid++ {
+			if ok, prefixed := b.isLinkMid(mid, hi); ok && prefixed == tgSpecial {
+				return mid
+			}
+		}
+		if hi <= lo+scanAhead {
 			return -1
 		}
+		b.buildLinkMids()
+	}
 
-		end := offset + idx
-		// validEnd check has double logic to account for multi char strings
-		if (validEnd(end, in) || isCodeBlockNewlineEnd(in, end, s)) && validEnd(end+len(s)-1, in) && !IsEscaped(in, end) {
-			idx = stringIndex(in[end+1:], s)
-			for idx == 0 {
-				end++
-				idx = stringIndex(in[end+1:], s)
-			}
-			return end
+	// Close to the end of the window, the URL prefix may be cut off; those are checked separately.
+	edge := max(lo, hi-b.maxLinkMidLen)
+	if mid := b.linkMids[special][lo]; mid < edge {
+		return mid
+	}
+	for mid := edge; mid < hi; mid++ {
+		if ok, prefixed := b.isLinkMid(mid, hi); ok && prefixed == tgSpecial {
+			return mid
 		}
-		offset = end + 1
 	}
 	return -1
 }
 
-func getLinkEnd(in []rune) int {
-	offset := 0
-	for offset < len(in) {
-		idx := stringIndex(in[offset:], ")")
-		if idx < 0 {
-			return -1
+func (b *parseBuffer) buildLinkMids() {
+	n := len(b.runes)
+	b.addWork(n)
+	for special := range b.linkMids {
+		b.linkMids[special] = make([]int, n+1)
+		b.prevLinkMids[special] = make([]int, n+1)
+	}
+	b.linkMids[0][n], b.linkMids[1][n] = n, n
+	for i := n - 1; i >= 0; i-- {
+		b.linkMids[0][i], b.linkMids[1][i] = b.linkMids[0][i+1], b.linkMids[1][i+1]
+		if ok, prefixed := b.isLinkMid(i, n); ok && prefixed {
+			b.linkMids[1][i] = i
+		} else if ok {
+			b.linkMids[0][i] = i
 		}
+	}
+	prev := [2]int{-1, -1}
+	for i := 0; i <= n; i++ {
+		if i < n {
+			if ok, prefixed := b.isLinkMid(i, n); ok && prefixed {
+				prev[1] = i
+			} else if ok {
+				prev[0] = i
+			}
+		}
+		b.prevLinkMids[0][i], b.prevLinkMids[1][i] = prev[0], prev[1]
+	}
+}
 
-		end := offset + idx
-		// we don't check validEnd, since links can be inlined
-		if !IsEscaped(in, end) {
-			return end
+// findLinkSectionsIdx finds the middle and closing sections of a link starting at lo, inside a window ending at hi.
+func (b *parseBuffer) findLinkSectionsIdx(lo int, hi int, tgSpecial bool) (int, int) {
+	textEnd := b.findLinkMidSectionIdx(lo, hi, tgSpecial)
+	if textEnd < 0 {
+		return -1, -1
+	}
+
+	linkEnd := b.findLinkEndSectionIdx(textEnd, hi)
+	if linkEnd < 0 {
+		return -1, -1
+	}
+
+	// We've found the first valid "mid" section above; and we've found the "end" section too.
+	// If any other mid sections exist between the two, we choose the last one instead - it would be invalid in a URL
+	// anyway. The ')' can't be part of a URL prefix, so the end of the window doesn't matter here.
+	if linkEnd-textEnd <= scanAhead {
+		for mid := linkEnd - 2; mid > textEnd; mid-- {
+			if ok, prefixed := b.isLinkMid(mid, linkEnd); ok && prefixed == tgSpecial {
+				return mid, linkEnd
+			}
 		}
-		offset = end + 1
+		return textEnd, linkEnd
+	}
+	special := 0
+	if tgSpecial {
+		special = 1
+	}
+	if b.prevLinkMids[special] == nil {
+		b.buildLinkMids()
+	}
+	if mid := b.prevLinkMids[special][linkEnd-2]; mid > textEnd {
+		textEnd = mid
+	}
+	return textEnd, linkEnd
+}
+
+// findLinkEndSectionIdx finds the closing ')' section of a link, starting at lo inside a window ending at hi.
+func (b *parseBuffer) findLinkEndSectionIdx(lo int, hi int) int {
+	if b.linkEnds == nil {
+		for i := lo; i < min(hi, lo+scanAhead); i++ {
+			// we don't check validEnd, since links can be inlined
+			if b.runes[i] == ')' && !b.isEscaped(0, i) {
+				return i
+			}
+		}
+		b.addWork(len(b.runes))
+		b.linkEnds = make([]int, len(b.runes)+1)
+		b.linkEnds[len(b.runes)] = len(b.runes)
+		for i := len(b.runes) - 1; i >= 0; i-- {
+			b.linkEnds[i] = b.linkEnds[i+1]
+			// we don't check validEnd, since links can be inlined
+			if b.runes[i] == ')' && !b.isEscaped(0, i) {
+				b.linkEnds[i] = i
+			}
+		}
+	}
+	if end := b.linkEnds[lo]; end < hi {
+		return end
 	}
 	return -1
 }
@@ -198,16 +421,6 @@ func getClosingTag(in []rune, openingTag string, closingTag string) (int, int) {
 	return -1, -1
 }
 
-func stringIndex(in []rune, s string) int {
-	r := []rune(s)
-	for idx := range in {
-		if startsWith(in[idx:], r) {
-			return idx
-		}
-	}
-	return -1
-}
-
 func startsWith(i []rune, p []rune) bool {
 	for idx, x := range p {
 		if idx >= len(i) || i[idx] != x {
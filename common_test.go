@@ -3,12 +3,30 @@ package tg_md2html_test
 import "github.com/PaulSonOfLars/gotg_md2html"
 
 func testConverter() *tg_md2html.ConverterV2 {
-	return tg_md2html.NewV2(map[string]string{
-		"url":  "buttonurl",
-		"text": "buttontext",
+	cv := tg_md2html.NewV2(map[string]string{
+		"url":                              "buttonurl",
+		"text":                             "buttontext",
+		"callback":                         "buttoncb",
+		"switch_inline_query":              "buttonswitch",
+		"switch_inline_query_current_chat": "buttonswitchhere",
+		"copy_text":                        "buttoncopy",
+		"web_app":                          "buttonwebapp",
+		"login_url":                        "buttonlogin",
+		"pay":                              "buttonpay",
 	}, map[string]string{
 		"primary": "primary",
 		"success": "success",
 		"danger":  "danger",
 	})
+	cv.ReplyPrefixes = map[string]string{
+		"reply_text":       "replytext",
+		"request_contact":  "replycontact",
+		"request_location": "replylocation",
+		"request_poll":     "replypoll",
+		"request_users":    "replyusers",
+		"request_chat":     "replychat",
+		"web_app":          "replywebapp",
+	}
+	cv.ReplyKeyboardPrefix = "replykeyboard"
+	return cv
 }
@@ -0,0 +1,308 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Delimiters maps each inline delimiter, such as "*" or "__", to the entity it creates.
+type Delimiters map[string]EntityType
+
+var ErrInvalidDelimiter = errors.New("invalid delimiter")
+
+// DefaultDelimiters returns telegram's MarkdownV2 delimiters, which are used when ConverterV2.Delimiters is nil.
+func DefaultDelimiters() Delimiters {
+	return Delimiters{
+		"*":   EntityBold,
+		"_":   EntityItalic,
+		"__":  EntityUnderline,
+		"~":   EntityStrikethrough,
+		"||":  EntitySpoiler,
+		"`":   EntityCode,
+		"```": EntityPre,
+	}
+}
+
+// reservedDelimiterChars are used by links, escapes, blockquotes and directives, or by the HTML escaping of the input,
+// so can't be part of a delimiter.
+const reservedDelimiterChars = "[]()!\\&<>\"'{}#;"
+
+// Validate checks that each delimiter is made of ASCII punctuation which isn't used by any other syntax, and creates
+// bold, italic, underline, strikethrough or spoiler text. Code and pre can be removed, but always use "`" and "```".
+func (d Delimiters) Validate() error {
+	for _, delim := range slices.Sorted(maps.Keys(d)) {
+		if err := validateDelimiter(delim, d[delim]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateDelimiter(delim string, t EntityType) error {
+	if delim == "" {
+		return fmt.Errorf("%w: empty delimiter for %s", ErrInvalidDelimiter, t)
+	}
+	for _, r := range delim {
+		if r > unicode.MaxASCII || !(unicode.IsPunct(r) || unicode.IsSymbol(r)) || strings.ContainsRune(reservedDelimiterChars, r) {
+			return fmt.Errorf("%w: %q can't contain %q", ErrInvalidDelimiter, delim, r)
+		}
+	}
+	switch {
+	case delim == "`" || t == EntityCode:
+		if delim != "`" || t != EntityCode {
+			return fmt.Errorf("%w: code must use %q", ErrInvalidDelimiter, "`")
+		}
+	case delim == "```" || t == EntityPre:
+		if delim != "```" || t != EntityPre {
+			return fmt.Errorf("%w: pre must use %q", ErrInvalidDelimiter, "```")
+		}
+	case strings.ContainsRune(delim, '`'):
+		return fmt.Errorf("%w: %q can't contain %q", ErrInvalidDelimiter, delim, '`')
+	case t != EntityBold && t != EntityItalic && t != EntityUnderline && t != EntityStrikethrough && t != EntitySpoiler:
+		return fmt.Errorf("%w: %q can't be used for %s", ErrInvalidDelimiter, delim, t)
+	}
+	return nil
+}
+
+// delimiterSet holds the lookup tables for a converter's delimiters.
+type delimiterSet struct {
+	// entities maps each delimiter to its entity, and byRune holds the delimiters starting with each rune, longest first.
+	entities map[string]EntityType
+	byRune   map[rune][]string
+	// reverse holds the delimiter used to write each entity back to markdown; the shortest one, if there are several.
+	reverse map[EntityType]string
+	// escapable holds the runes which can be escaped with a backslash. This always includes the default delimiters, so
+	// that escapes keep working when a delimiter is removed.
+	escapable map[rune]bool
+	// markdownChars holds the runes escaped by EscapeMarkdown, and reverseChars those escaped by Reverse.
+	markdownChars []rune
+	reverseChars  string
+	// runChars holds the runes of reverseChars which are only used in longer delimiters, such as the '|' of "||". They
+	// are only escaped where they could form a delimiter; see escapeText.
+	runChars string
+}
+
+// The MarkdownV2 characters used by links, escapes and blockquotes are always escaped, whatever the delimiters.
+const (
+	structuralMarkdownChars = "!&()[\\]"
+	structuralReverseChars  = "\\!>[]()"
+)
+
+var (
+	defaultDelimiterSet           = newDelimiterSet(DefaultDelimiters(), false)
+	defaultDirectivesDelimiterSet = newDelimiterSet(DefaultDelimiters(), true)
+)
+
+// delimiters returns the lookup tables for the converter's delimiters. Invalid delimiters are ignored; see Validate.
+func (cv ConverterV2) delimiters() *delimiterSet {
+	directives := len(cv.Directives) > 0
+	if cv.Delimiters == nil {
+		if directives {
+			return defaultDirectivesDelimiterSet
+		}
+		return defaultDelimiterSet
+	}
+	return newDelimiterSet(cv.Delimiters, directives)
+}
+
+// newDelimiterSet builds the lookup tables for the delimiters. If directives are used, '{' is escaped too, so that
+// text in braces can be kept as-is.
+func newDelimiterSet(delims Delimiters, directives bool) *delimiterSet {
+	d := &delimiterSet{
+		entities:  map[string]EntityType{},
+		byRune:    map[rune][]string{},
+		reverse:   map[EntityType]string{},
+		escapable: map[rune]bool{},
+	}
+	for _, r := range structuralMarkdownChars {
+		d.escapable[r] = true
+	}
+	for delim := range DefaultDelimiters() {
+		d.escapable[rune(delim[0])] = true
+	}
+
+	markdownChars := map[rune]bool{}
+	for _, r := range structuralMarkdownChars {
+		markdownChars[r] = true
+	}
+	reverseChars := structuralReverseChars
+	if directives {
+		d.escapable['{'] = true
+		markdownChars['{'] = true
+		reverseChars += "{"
+	}
+	for delim, t := range delims {
+		if validateDelimiter(delim, t) != nil {
+			continue
+		}
+		d.entities[delim] = t
+		r := rune(delim[0])
+		d.byRune[r] = append(d.byRune[r], delim)
+		if prev, ok := d.reverse[t]; !ok || len(delim) < len(prev) || (len(delim) == len(prev) && delim < prev) {
+			d.reverse[t] = delim
+		}
+		for _, r := range delim {
+			d.escapable[r] = true
+			markdownChars[r] = true
+			if !strings.ContainsRune(reverseChars, r) {
+				reverseChars += string(r)
+			}
+		}
+	}
+	for _, r := range reverseChars {
+		if strings.ContainsRune(structuralReverseChars, r) || r == '{' {
+			continue
+		}
+		if _, single := d.entities[string(r)]; !single {
+			d.runChars += string(r)
+		}
+	}
+	for _, ds := range d.byRune {
+		sort.Slice(ds, func(i, j int) bool {
+			if len(ds[i]) != len(ds[j]) {
+				return len(ds[i]) > len(ds[j])
+			}
+			return ds[i] < ds[j]
+		})
+	}
+	for r := range markdownChars {
+		d.markdownChars = append(d.markdownChars, r)
+	}
+	slices.Sort(d.markdownChars)
+	d.reverseChars = reverseChars
+	return d
+}
+
+// getItem returns the markdown item starting at i, the number of extra runes it uses, and whether it is a valid start.
+// If the rune at i escapes the next one, that rune is returned, and the item isn't valid.
+func (d *delimiterSet) getItem(in []rune, i int) (string, int, bool) {
+	c := in[i]
+	if !d.escapable[c] {
+		return "", 0, false
+	}
+
+	if !validStart(i, in) && !skipStarts[c] {
+		if c == '\\' && i+1 < len(in) && d.escapable[in[i+1]] {
+			return string(in[i+1]), 1, false
+		}
+		return "", 0, false
+	}
+
+	if c == '&' &&
+		i+3 < len(in) && in[i+1] == 'g' && in[i+2] == 't' && in[i+3] == ';' &&
+		validBlockQuoteStart(in, i) {
+		return "&gt;", 3, true
+
+	} else if c == '*' &&
+		i+5 < len(in) && in[i+1] == '*' && in[i+2] == '&' && in[i+3] == 'g' && in[i+4] == 't' && in[i+5] == ';' &&
+		// We force support for **> to allow for people to separate quotes/expandable quote blocks with **
+		validBlockQuoteStart(in, i) {
+		return "**&gt;", 5, true
+
+	} else if c == '!' && i+1 < len(in) && in[i+1] == '[' {
+		return "![", 1, true
+	}
+
+	for _, delim := range d.byRune[c] {
+		if hasDelimiter(in, i, delim) {
+			return delim, len(delim) - 1, true
+		}
+	}
+	return string(c), 0, true
+}
+
+// hasDelimiter reports whether the delimiter starts at i.
+func hasDelimiter(in []rune, i int, delim string) bool {
+	if i+len(delim) > len(in) {
+		return false
+	}
+	for idx := range len(delim) {
+		if in[i+idx] != rune(delim[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EscapeMarkdown escapes any of the converter's markdown characters which could otherwise be parsed as markdown.
+func (cv ConverterV2) EscapeMarkdown(r []rune) string {
+	return escapeMarkdown(r, cv.delimiters().markdownChars)
+}
+
+// escapeReverse escapes all the characters which would otherwise be parsed as markdown.
+func (d *delimiterSet) escapeReverse(s string) string {
+	out := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(d.reverseChars, r) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// textEdge describes the markdown directly before or after a text node, when reversing: the rune written there, and
+// whether it is part of the delimiter of the entity containing the text.
+type textEdge struct {
+	r     rune
+	delim bool
+}
+
+// escapeText escapes a text node for Reverse, like escapeReverse. Runes from runChars are only escaped where they could
+// form a delimiter: when two or more are next to each other, or when they are next to the same rune in the markdown
+// before or after the text. Runs at the start or end of an entity whose delimiter is made of the same rune are kept as
+// they are, since they merge into the delimiter; eg a spoiler of "||" is written as ||||||.
+func (d *delimiterSet) escapeText(s string, before textEdge, after textEdge) string {
+	if d.runChars == "" {
+		return d.escapeReverse(s)
+	}
+	in := []rune(s)
+	out := strings.Builder{}
+	for i := 0; i < len(in); i++ {
+		r := in[i]
+		if !strings.ContainsRune(d.runChars, r) {
+			if strings.ContainsRune(d.reverseChars, r) {
+				out.WriteRune('\\')
+			}
+			out.WriteRune(r)
+			continue
+		}
+
+		end := i + 1
+		for end < len(in) && in[end] == r {
+			end++
+		}
+		// Runs next to the same rune merge with it, which is only wanted when it is the delimiter around the text.
+		mergesBefore, mergesAfter := i == 0 && before.r == r, end == len(in) && after.r == r
+		escape := (mergesBefore && !before.delim) || (mergesAfter && !after.delim) ||
+			(end-i > 1 && !mergesBefore && !mergesAfter)
+		for ; i < end; i++ {
+			if escape {
+				out.WriteRune('\\')
+			}
+			out.WriteRune(r)
+		}
+		i--
+	}
+	return out.String()
+}
+
+// checkReverse checks that every entity in the nodes has a delimiter to write it back to markdown with.
+func (d *delimiterSet) checkReverse(nodes []Node) error {
+	var err error
+	walkNodes(nodes, func(n Node) {
+		switch n.(type) {
+		case *Bold, *Italic, *Underline, *Strike, *Spoiler, *Code, *Pre:
+			t := nodeEntityType(n)
+			if _, ok := d.reverse[t]; !ok && err == nil {
+				err = fmt.Errorf("%w: no delimiter for %s", ErrInvalidDelimiter, t)
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+// githubConverter uses GitHub style delimiters, without underline or single ~ strikethrough.
+func githubConverter() *tg_md2html.ConverterV2 {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.Delimiters = tg_md2html.Delimiters{
+		"**":  tg_md2html.EntityBold,
+		"*":   tg_md2html.EntityItalic,
+		"_":   tg_md2html.EntityItalic,
+		"~~":  tg_md2html.EntityStrikethrough,
+		"||":  tg_md2html.EntitySpoiler,
+		"`":   tg_md2html.EntityCode,
+		"```": tg_md2html.EntityPre,
+	}
+	return cv
+}
+
+func TestDelimitersV2(t *testing.T) {
+	cv := githubConverter()
+	for _, x := range []struct {
+		name    string
+		in      string
+		out     string
+		reverse string
+	}{
+		{
+			name:    "bold and italic",
+			in:      "**bold** *italic* _italic_",
+			out:     "<b>bold</b> <i>italic</i> <i>italic</i>",
+			reverse: "**bold** *italic* *italic*",
+		}, {
+			name:    "nested",
+			in:      "**bold *and italic***",
+			out:     "<b>bold <i>and italic</i></b>",
+			reverse: "**bold *and italic***",
+		}, {
+			name:    "strikethrough",
+			in:      "~~gone~~ in ~5 minutes",
+			out:     "<s>gone</s> in ~5 minutes",
+			reverse: "~~gone~~ in ~5 minutes",
+		}, {
+			name:    "inside words",
+			in:      "snake_case and **_both_**",
+			out:     "snake_case and <b><i>both</i></b>",
+			reverse: "snake\\_case and ***both***",
+		}, {
+			name:    "escaped",
+			in:      "\\*\\* not bold",
+			out:     "** not bold",
+			reverse: "\\*\\* not bold",
+		}, {
+			name:    "code and blockquotes",
+			in:      "`code`\n>quote",
+			out:     "<code>code</code>\n<blockquote>quote</blockquote>",
+			reverse: "`code`\n>quote",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.out, cv.MD2HTML(x.in))
+
+			out, err := cv.Reverse(x.out, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.reverse, out)
+			assert.Equal(t, x.out, cv.MD2HTML(out))
+		})
+	}
+}
+
+func TestDelimitersV2Disabled(t *testing.T) {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.Delimiters = tg_md2html.DefaultDelimiters()
+	delete(cv.Delimiters, "~")
+
+	assert.Equal(t, "back in ~5 minutes, <b>maybe</b>", cv.MD2HTML("back in ~5 minutes, *maybe*"))
+	// Escapes still work for removed delimiters.
+	assert.Equal(t, "~", cv.MD2HTML("\\~"))
+
+	out, err := cv.Reverse("back in ~5 minutes", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "back in ~5 minutes", out)
+
+	_, err = cv.Reverse("<s>gone</s>", nil)
+	assert.ErrorIs(t, err, tg_md2html.ErrInvalidDelimiter)
+}
+
+func TestDelimitersV2EscapeMarkdown(t *testing.T) {
+	assert.Equal(t, "\\~a\\~ \\_b\\_", tg_md2html.EscapeMarkdownV2([]rune("~a~ _b_")))
+
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.Delimiters = tg_md2html.DefaultDelimiters()
+	delete(cv.Delimiters, "~")
+	assert.Equal(t, "~a~ \\_b\\_", cv.EscapeMarkdown([]rune("~a~ _b_")))
+}
+
+func TestDelimitersV2Validate(t *testing.T) {
+	assert.NoError(t, tg_md2html.DefaultDelimiters().Validate())
+	assert.NoError(t, githubConverter().Delimiters.Validate())
+
+	for name, d := range map[string]tg_md2html.Delimiters{
+		"empty":          {"": tg_md2html.EntityBold},
+		"letters":        {"b": tg_md2html.EntityBold},
+		"reserved":       {"[[": tg_md2html.EntityBold},
+		"non-ascii":      {"§": tg_md2html.EntityBold},
+		"code remapped":  {"``": tg_md2html.EntityCode},
+		"code for bold":  {"`": tg_md2html.EntityBold},
+		"pre remapped":   {"~~~": tg_md2html.EntityPre},
+		"not formatting": {"%": tg_md2html.EntityTextLink},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorIs(t, d.Validate(), tg_md2html.ErrInvalidDelimiter)
+		})
+	}
+}
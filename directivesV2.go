@@ -0,0 +1,165 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Directive is a send option set from inside the text, such as {nopreview}. Directives are removed from the output,
+// and returned as MessageOptions.
+type Directive string
+
+const (
+	DirectivePreview        Directive = "preview"
+	DirectiveNoPreview      Directive = "nopreview"
+	DirectivePreviewTop     Directive = "preview_top"
+	DirectiveProtect        Directive = "protect"
+	DirectiveNoNotification Directive = "no_notification"
+	DirectiveMediaSpoiler   Directive = "media_spoiler"
+)
+
+var ErrUnknownDirective = errors.New("unknown directive")
+
+// DefaultDirectives returns the default names of the directives. The default converter doesn't parse directives, so
+// that text in braces is kept as-is; set ConverterV2.Directives to use them.
+func DefaultDirectives() map[Directive]string {
+	return map[Directive]string{
+		DirectivePreview:        "preview",
+		DirectiveNoPreview:      "nopreview",
+		DirectivePreviewTop:     "preview:top",
+		DirectiveProtect:        "protect",
+		DirectiveNoNotification: "nonotif",
+		DirectiveMediaSpoiler:   "mediaspoiler",
+	}
+}
+
+// MessageOptions are the send options set by the directives in the text.
+type MessageOptions struct {
+	// Preview and NoPreview force the link preview on or off. If neither is set, the bot's default should be used.
+	Preview   bool
+	NoPreview bool
+	// PreviewAboveText shows the link preview above the text. It also sets Preview.
+	PreviewAboveText bool
+	// Protect stops the message from being forwarded or saved.
+	Protect bool
+	// NoNotification sends the message silently.
+	NoNotification bool
+	// MediaSpoiler covers the message's media with a spoiler.
+	MediaSpoiler bool
+}
+
+// DirectiveNode is a directive found in the text. Directives are not part of the rendered text.
+type DirectiveNode struct {
+	Directive Directive
+}
+
+func (*DirectiveNode) node() {}
+
+// Directives returns all the directives in the document, in the order they are first used.
+func (d *Document) Directives() []Directive {
+	var ds []Directive
+	walkNodes(d.Nodes, func(n Node) {
+		if dn, ok := n.(*DirectiveNode); ok && !slices.Contains(ds, dn.Directive) {
+			ds = append(ds, dn.Directive)
+		}
+	})
+	return ds
+}
+
+// Options returns the send options set by the document's directives.
+func (d *Document) Options() MessageOptions {
+	var opts MessageOptions
+	for _, dir := range d.Directives() {
+		switch dir {
+		case DirectivePreview:
+			opts.Preview = true
+		case DirectiveNoPreview:
+			opts.NoPreview = true
+		case DirectivePreviewTop:
+			opts.Preview = true
+			opts.PreviewAboveText = true
+		case DirectiveProtect:
+			opts.Protect = true
+		case DirectiveNoNotification:
+			opts.NoNotification = true
+		case DirectiveMediaSpoiler:
+			opts.MediaSpoiler = true
+		}
+	}
+	return opts
+}
+
+// Directives returns the directives which set these options, so they can be passed to Reverse.
+func (o MessageOptions) Directives() []Directive {
+	var ds []Directive
+	switch {
+	case o.PreviewAboveText:
+		ds = append(ds, DirectivePreviewTop)
+	case o.Preview:
+		ds = append(ds, DirectivePreview)
+	}
+	if o.NoPreview {
+		ds = append(ds, DirectiveNoPreview)
+	}
+	if o.Protect {
+		ds = append(ds, DirectiveProtect)
+	}
+	if o.NoNotification {
+		ds = append(ds, DirectiveNoNotification)
+	}
+	if o.MediaSpoiler {
+		ds = append(ds, DirectiveMediaSpoiler)
+	}
+	return ds
+}
+
+// directiveNames maps the escaped name of each of the converter's directives to the directive, and returns the length
+// of the longest name.
+func (cv ConverterV2) directiveNames() (map[string]Directive, int) {
+	if len(cv.Directives) == 0 {
+		return nil, 0
+	}
+	names := make(map[string]Directive, len(cv.Directives))
+	maxLen := 0
+	for d, name := range cv.Directives {
+		name = html.EscapeString(name)
+		names[name] = d
+		maxLen = max(maxLen, utf8.RuneCountInString(name))
+	}
+	return names, maxLen
+}
+
+// getDirective checks whether a directive starts at i, and returns it and its end if so. Only the longest directive name
+// is searched for the closing '}', so this is constant time.
+func (p *parserV2) getDirective(b *parseBuffer, lo int, i int, hi int) (Directive, int, bool) {
+	if b.runes[i] != '{' || p.directives == nil || b.isEscaped(lo, i) {
+		return "", 0, false
+	}
+	for j := i + 1; j < hi && j <= i+1+p.maxDirectiveLen; j++ {
+		if b.runes[j] == '}' {
+			d, ok := p.directives[string(b.runes[i+1:j])]
+			return d, j + 1, ok
+		}
+	}
+	return "", 0, false
+}
+
+// writeDirectives writes the directives on their own line, before any buttons.
+func (cv ConverterV2) writeDirectives(out *strings.Builder, ds []Directive) error {
+	if len(ds) == 0 {
+		return nil
+	}
+	out.WriteString("\n")
+	for _, d := range ds {
+		name, ok := cv.Directives[d]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownDirective, d)
+		}
+		out.WriteString("{" + name + "}")
+	}
+	return nil
+}
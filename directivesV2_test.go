@@ -0,0 +1,88 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+// directivesConverter is the test converter, with the default directives.
+func directivesConverter() *tg_md2html.ConverterV2 {
+	cv := testConverter()
+	cv.Directives = tg_md2html.DefaultDirectives()
+	return cv
+}
+
+func TestDirectivesV2(t *testing.T) {
+	cv := directivesConverter()
+	for _, x := range []struct {
+		name string
+		in   string
+		out  string
+		opts tg_md2html.MessageOptions
+	}{
+		{
+			name: "flags",
+			in:   "{nopreview}Hello *there*{protect}\n{nonotif} {mediaspoiler}",
+			out:  "Hello <b>there</b>",
+			opts: tg_md2html.MessageOptions{NoPreview: true, Protect: true, NoNotification: true, MediaSpoiler: true},
+		}, {
+			name: "preview on top",
+			in:   "Read [this](https://example.com) {preview:top}",
+			out:  `Read <a href="https://example.com">this</a>`,
+			opts: tg_md2html.MessageOptions{Preview: true, PreviewAboveText: true},
+		}, {
+			name: "inside formatting",
+			in:   "*bold {preview}*",
+			out:  "<b>bold </b>",
+			opts: tg_md2html.MessageOptions{Preview: true},
+		}, {
+			name: "ignored in code",
+			in:   "`{protect}`\n```\n{nonotif}```",
+			out:  "<code>{protect}</code>\n<pre>{nonotif}</pre>",
+		}, {
+			name: "escaped and unknown",
+			in:   `\{protect} {first} {protect`,
+			out:  `{protect} {first} {protect`,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			res := cv.Convert(x.in)
+			assert.Equal(t, x.out, res.HTML)
+			assert.Equal(t, x.opts, res.Options)
+		})
+	}
+}
+
+func TestDirectivesV2Default(t *testing.T) {
+	res := tg_md2html.ConvertV2("hello {protect} world \\{x}")
+	assert.Equal(t, `hello {protect} world \{x}`, res.HTML)
+	assert.Equal(t, tg_md2html.MessageOptions{}, res.Options)
+
+	out, issues, err := tg_md2html.MigrateV1ToV2("{protect} hi", nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, issues)
+	assert.Equal(t, "{protect} hi", out)
+}
+
+func TestReverseV2Directives(t *testing.T) {
+	in := "Hello *there*\n{preview:top}{protect}\n[Rules](buttonurl://example.com)"
+	cv := directivesConverter()
+	res := cv.Convert(in)
+
+	out, err := cv.Reverse(res.HTML, res.Buttons, res.Options.Directives()...)
+	assert.NoError(t, err)
+	assert.Equal(t, in, out)
+
+	// Braces in the text are escaped, so they aren't read as directives.
+	out, err = cv.Reverse("{protect} {x}", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `\{protect} \{x}`, out)
+	assert.Equal(t, "{protect} {x}", cv.Convert(out).HTML)
+	assert.Equal(t, `\{protect}`, cv.EscapeMarkdown([]rune("{protect}")))
+
+	_, err = tg_md2html.NewV2(nil, nil).Reverse(res.HTML, nil, tg_md2html.DirectiveProtect)
+	assert.ErrorIs(t, err, tg_md2html.ErrUnknownDirective)
+}
@@ -0,0 +1,369 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// EntityType is the type of a telegram MessageEntity.
+type EntityType string
+
+const (
+	EntityBold                 EntityType = "bold"
+	EntityItalic               EntityType = "italic"
+	EntityUnderline            EntityType = "underline"
+	EntityStrikethrough        EntityType = "strikethrough"
+	EntitySpoiler              EntityType = "spoiler"
+	EntityCode                 EntityType = "code"
+	EntityPre                  EntityType = "pre"
+	EntityTextLink             EntityType = "text_link"
+	EntityTextMention          EntityType = "text_mention"
+	EntityCustomEmoji          EntityType = "custom_emoji"
+	EntityDateTime             EntityType = "date_time"
+	EntityBlockquote           EntityType = "blockquote"
+	EntityExpandableBlockquote EntityType = "expandable_blockquote"
+)
+
+// MessageEntity is a telegram message entity, as sent alongside plain text instead of a parse_mode.
+// Offsets and lengths are counted in UTF-16 code units.
+// https://core.telegram.org/bots/api#messageentity
+type MessageEntity struct {
+	Type   EntityType `json:"type"`
+	Offset int        `json:"offset"`
+	Length int        `json:"length"`
+	// For "text_link" only, the URL that will be opened.
+	URL string `json:"url,omitempty"`
+	// For "text_mention" only, the mentioned user.
+	User *User `json:"user,omitempty"`
+	// For "pre" only, the programming language of the entity text.
+	Language string `json:"language,omitempty"`
+	// For "custom_emoji" only, the unique identifier of the custom emoji.
+	CustomEmojiID string `json:"custom_emoji_id,omitempty"`
+	// For "date_time" only, the unix time to display.
+	UnixTime int64 `json:"unix_time,omitempty"`
+	// For "date_time" only, how the date should be formatted.
+	DateTimeFormat string `json:"date_time_format,omitempty"`
+}
+
+// User is the subset of a telegram User needed for text mentions.
+// https://core.telegram.org/bots/api#user
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+func MD2EntitiesV2(in string) (string, []MessageEntity) {
+	return defaultConverterV2.MD2Entities(in)
+}
+
+func MD2EntitiesButtonsV2(in string) (string, []MessageEntity, []ButtonV2) {
+	return defaultConverterV2.MD2EntitiesButtons(in)
+}
+
+// MD2Entities converts markdown to plain text, and the list of entities needed to format it.
+func (cv ConverterV2) MD2Entities(in string) (string, []MessageEntity) {
+	return cv.RenderEntities(cv.parse(in, false))
+}
+
+// MD2EntitiesButtons converts markdown to plain text and entities, and returns any buttons separately.
+func (cv ConverterV2) MD2EntitiesButtons(in string) (string, []MessageEntity, []ButtonV2) {
+	doc := cv.parse(in, true)
+	text, entities := cv.RenderEntities(doc)
+	return text, entities, doc.Buttons()
+}
+
+func HTML2EntitiesV2(in string) (string, []MessageEntity, error) {
+	return defaultConverterV2.HTML2Entities(in)
+}
+
+// HTML2Entities converts telegram-flavoured HTML, such as the output of MD2HTML, to plain text and its entities.
+func (cv ConverterV2) HTML2Entities(in string) (string, []MessageEntity, error) {
+	doc, err := cv.ParseHTML(in)
+	if err != nil {
+		return "", nil, err
+	}
+	text, entities := cv.RenderEntities(doc)
+	return text, entities, nil
+}
+
+// RenderEntities converts a parsed Document to plain text and its entities.
+// Entities are ordered by offset, with outer entities before the ones nested inside them.
+func (cv ConverterV2) RenderEntities(doc *Document) (string, []MessageEntity) {
+	w := entityWriter{}
+	w.writeNodes(doc.Nodes)
+	return w.out.String(), w.entities
+}
+
+type entityWriter struct {
+	out      strings.Builder
+	offset   int
+	entities []MessageEntity
+}
+
+func (w *entityWriter) writeNodes(nodes []Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *Text:
+			w.writeText(n.Value)
+		case *Bold:
+			w.writeEntity(MessageEntity{Type: EntityBold}, n.Children)
+		case *Italic:
+			w.writeEntity(MessageEntity{Type: EntityItalic}, n.Children)
+		case *Underline:
+			w.writeEntity(MessageEntity{Type: EntityUnderline}, n.Children)
+		case *Strike:
+			w.writeEntity(MessageEntity{Type: EntityStrikethrough}, n.Children)
+		case *Spoiler:
+			w.writeEntity(MessageEntity{Type: EntitySpoiler}, n.Children)
+		case *Code:
+			w.writeEntity(MessageEntity{Type: EntityCode}, []Node{&Text{Value: n.Value}})
+		case *Pre:
+			w.writeEntity(MessageEntity{Type: EntityPre, Language: n.Language}, []Node{&Text{Value: n.Value}})
+		case *Link:
+			w.writeEntity(MessageEntity{Type: EntityTextLink, URL: n.URL}, n.Children)
+		case *Mention:
+			w.writeEntity(MessageEntity{Type: EntityTextMention, User: &User{ID: n.UserID}}, n.Children)
+		case *CustomEmoji, *Time, *SpecialLink:
+			h, data, nested := specialLink(n)
+			w.writeEntity(h.Entity(data), nested)
+		case *Blockquote:
+			if n.Expandable {
+				w.writeEntity(MessageEntity{Type: EntityExpandableBlockquote}, n.Children)
+			} else {
+				w.writeEntity(MessageEntity{Type: EntityBlockquote}, n.Children)
+			}
+		case *ButtonNode, *ReplyButtonNode, *ReplyKeyboardNode, *DirectiveNode:
+			// Buttons and directives are returned separately; they aren't part of the text.
+		}
+	}
+}
+
+func (w *entityWriter) writeText(s string) {
+	w.out.WriteString(s)
+	w.offset += utf16Len(s)
+}
+
+func (w *entityWriter) writeEntity(e MessageEntity, nodes []Node) {
+	// Add the entity before writing its contents, so that it comes before any nested entities.
+	idx := len(w.entities)
+	w.entities = append(w.entities, e)
+
+	start := w.offset
+	w.writeNodes(nodes)
+	if w.offset == start {
+		// Telegram doesn't accept empty entities.
+		w.entities = slices.Delete(w.entities, idx, idx+1)
+		return
+	}
+	w.entities[idx].Offset = start
+	w.entities[idx].Length = w.offset - start
+}
+
+// ParseEntities converts plain text and its entities, as received from telegram, into a Document, using the default
+// converter.
+func ParseEntities(text string, entities []MessageEntity) (*Document, error) {
+	return defaultConverterV2.ParseEntities(text, entities)
+}
+
+// ParseEntities converts plain text and its entities, as received from telegram, into a Document.
+// Overlapping entities are split so that they nest correctly, and entity types which don't affect formatting
+// (eg hashtags or bot commands) are ignored. Entities claimed by one of the converter's LinkHandlers become SpecialLinks.
+func (cv ConverterV2) ParseEntities(text string, entities []MessageEntity) (*Document, error) {
+	runes := []rune(text)
+	allSpans, err := getEntitySpans(runes, entities)
+	if err != nil {
+		return nil, err
+	}
+
+	var spans []entitySpan
+	for idx, s := range allSpans {
+		if h, data, ok := cv.parseSpecialEntity(s.entity); ok {
+			s.handler, s.data = h, data
+		} else if !formattingEntity(s.entity.Type) {
+			continue
+		}
+		if !cv.allowsEntity(s.entity.Type) {
+			// Dropping the entity keeps its contents.
+			continue
+		}
+		if s.entity.Type == EntityTextMention && s.entity.User == nil {
+			return nil, fmt.Errorf("entity %d (%s) has no user", idx, s.entity.Type)
+		}
+		if s.start == s.end {
+			continue
+		}
+		spans = append(spans, s)
+	}
+
+	return &Document{Nodes: entitiesToNodes(runes, nestSpans(spans))}, nil
+}
+
+// getEntitySpans converts the UTF-16 offsets of each entity to rune indexes in the text.
+func getEntitySpans(text []rune, entities []MessageEntity) ([]entitySpan, error) {
+	offsets := utf16Offsets(text)
+	runeIdx := func(offset int) (int, bool) {
+		idx, ok := slices.BinarySearch(offsets, offset)
+		return idx, ok
+	}
+
+	spans := make([]entitySpan, 0, len(entities))
+	for idx, e := range entities {
+		start, okStart := runeIdx(e.Offset)
+		end, okEnd := runeIdx(e.Offset + e.Length)
+		if !okStart || !okEnd || e.Length < 0 {
+			return nil, fmt.Errorf("entity %d (%s) has invalid offset %d and length %d for text of length %d",
+				idx, e.Type, e.Offset, e.Length, offsets[len(offsets)-1])
+		}
+		spans = append(spans, entitySpan{entity: e, start: start, end: end})
+	}
+	return spans, nil
+}
+
+// utf16Offsets returns the UTF-16 offset of each rune in the text, followed by the total length.
+func utf16Offsets(text []rune) []int {
+	offsets := make([]int, 0, len(text)+1)
+	offset := 0
+	for _, r := range text {
+		offsets = append(offsets, offset)
+		offset += utf16RuneLen(r)
+	}
+	return append(offsets, offset)
+}
+
+type entitySpan struct {
+	entity MessageEntity
+	// start and end rune indexes of the entity.
+	start int
+	end   int
+	// handler and data are set when the entity is a special link.
+	handler LinkHandler
+	data    any
+}
+
+func formattingEntity(t EntityType) bool {
+	switch t {
+	case EntityBold, EntityItalic, EntityUnderline, EntityStrikethrough, EntitySpoiler, EntityCode, EntityPre,
+		EntityTextLink, EntityTextMention, EntityCustomEmoji, EntityDateTime, EntityBlockquote, EntityExpandableBlockquote:
+		return true
+	}
+	return false
+}
+
+// nestSpans sorts the spans so that outer spans come before inner ones, and splits any span which overlaps the end
+// of the span containing it.
+func nestSpans(spans []entitySpan) []entitySpan {
+	sortSpans := func(s []entitySpan) {
+		sort.SliceStable(s, func(i, j int) bool {
+			if s[i].start != s[j].start {
+				return s[i].start < s[j].start
+			}
+			return s[i].end > s[j].end
+		})
+	}
+	sortSpans(spans)
+
+	var out []entitySpan
+	var open []int // ends of the currently open spans
+	for len(spans) > 0 {
+		s := spans[0]
+		spans = spans[1:]
+
+		for len(open) > 0 && open[len(open)-1] <= s.start {
+			open = open[:len(open)-1]
+		}
+
+		if len(open) > 0 && s.end > open[len(open)-1] {
+			// Overlaps the end of the containing span; split it in two, and handle the remainder later.
+			rest := s
+			rest.start = open[len(open)-1]
+			s.end = rest.start
+			spans = append(spans, rest)
+			sortSpans(spans)
+		}
+
+		out = append(out, s)
+		open = append(open, s.end)
+	}
+	return out
+}
+
+// entitiesToNodes converts correctly nested spans into nodes.
+func entitiesToNodes(text []rune, spans []entitySpan) []Node {
+	i := 0
+	var build func(start int, end int) []Node
+	build = func(start int, end int) []Node {
+		var nodes []Node
+		pos := start
+		for i < len(spans) && spans[i].start < end {
+			s := spans[i]
+			i++
+			if s.start > pos {
+				nodes = append(nodes, &Text{Value: string(text[pos:s.start])})
+			}
+			if s.handler != nil {
+				nodes = append(nodes, newSpecialLink(s.handler, s.data, build(s.start, s.end)))
+			} else {
+				nodes = append(nodes, entityNode(s.entity, string(text[s.start:s.end]), build(s.start, s.end)))
+			}
+			pos = s.end
+		}
+		if pos < end {
+			nodes = append(nodes, &Text{Value: string(text[pos:end])})
+		}
+		return nodes
+	}
+	return build(0, len(text))
+}
+
+func entityNode(e MessageEntity, text string, nested []Node) Node {
+	switch e.Type {
+	case EntityBold:
+		return &Bold{Children: nested}
+	case EntityItalic:
+		return &Italic{Children: nested}
+	case EntityUnderline:
+		return &Underline{Children: nested}
+	case EntityStrikethrough:
+		return &Strike{Children: nested}
+	case EntitySpoiler:
+		return &Spoiler{Children: nested}
+	case EntityCode:
+		// code and pre can't contain other entities.
+		return &Code{Value: text}
+	case EntityPre:
+		return &Pre{Language: e.Language, Value: text}
+	case EntityTextLink:
+		return &Link{URL: e.URL, Children: nested}
+	case EntityTextMention:
+		return &Mention{UserID: e.User.ID, Children: nested}
+	case EntityCustomEmoji:
+		return &CustomEmoji{ID: e.CustomEmojiID, Children: nested}
+	case EntityDateTime:
+		return &Time{Unix: e.UnixTime, Format: e.DateTimeFormat, Children: nested}
+	case EntityExpandableBlockquote:
+		return &Blockquote{Expandable: true, Children: nested}
+	default: // EntityBlockquote
+		return &Blockquote{Children: nested}
+	}
+}
+
+// utf16Len returns the length of s in UTF-16 code units, as telegram counts offsets.
+func utf16Len(s string) int {
+	l := 0
+	for _, r := range s {
+		l += utf16RuneLen(r)
+	}
+	return l
+}
+
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,170 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+var md2EntitiesV2 = []struct {
+	in       string
+	text     string
+	entities []tg_md2html.MessageEntity
+}{
+	{
+		in:   "hello",
+		text: "hello",
+	}, {
+		in:   "*hello* there",
+		text: "hello there",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityBold, Offset: 0, Length: 5},
+		},
+	}, {
+		in:   "*bold _italic_* ~strike~ __underline__ ||spoiler||",
+		text: "bold italic strike underline spoiler",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityBold, Offset: 0, Length: 11},
+			{Type: tg_md2html.EntityItalic, Offset: 5, Length: 6},
+			{Type: tg_md2html.EntityStrikethrough, Offset: 12, Length: 6},
+			{Type: tg_md2html.EntityUnderline, Offset: 19, Length: 9},
+			{Type: tg_md2html.EntitySpoiler, Offset: 29, Length: 7},
+		},
+	}, {
+		// Emoji outside the BMP take two UTF-16 code units.
+		in:   "👍👍 *bold* `<code>`",
+		text: "👍👍 bold <code>",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityBold, Offset: 5, Length: 4},
+			{Type: tg_md2html.EntityCode, Offset: 10, Length: 6},
+		},
+	}, {
+		in:   "```go\nfmt.Println(\"hi\")```",
+		text: "fmt.Println(\"hi\")",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityPre, Offset: 0, Length: 17, Language: "go"},
+		},
+	}, {
+		in:   "[link & text](example.com?a=1&b=2)",
+		text: "link & text",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityTextLink, Offset: 0, Length: 11, URL: "example.com?a=1&b=2"},
+		},
+	}, {
+		in:   "hi [user](tg://user?id=1234)",
+		text: "hi user",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityTextMention, Offset: 3, Length: 4, User: &tg_md2html.User{ID: 1234}},
+		},
+	}, {
+		in:   "![👍](tg://emoji?id=5368324170671202286) at ![22:45](tg://time?unix=1647531900&format=wDT)",
+		text: "👍 at 22:45",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityCustomEmoji, Offset: 0, Length: 2, CustomEmojiID: "5368324170671202286"},
+			{Type: tg_md2html.EntityDateTime, Offset: 6, Length: 5, UnixTime: 1647531900, DateTimeFormat: "wDT"},
+		},
+	}, {
+		in:   ">normal quote\n**>expandable\n>quote||",
+		text: "normal quote\nexpandable\nquote",
+		entities: []tg_md2html.MessageEntity{
+			{Type: tg_md2html.EntityBlockquote, Offset: 0, Length: 12},
+			{Type: tg_md2html.EntityExpandableBlockquote, Offset: 13, Length: 16},
+		},
+	},
+}
+
+func TestMD2EntitiesV2(t *testing.T) {
+	for _, x := range md2EntitiesV2 {
+		t.Run(x.in, func(t *testing.T) {
+			text, entities := tg_md2html.MD2EntitiesV2(x.in)
+			assert.Equal(t, x.text, text)
+			assert.Equal(t, x.entities, entities)
+		})
+	}
+}
+
+func TestMD2EntitiesButtonsV2(t *testing.T) {
+	text, entities, btns := tg_md2html.MD2EntitiesButtonsV2("Some *text*\n[hello](buttonurl://example.com)")
+	assert.Equal(t, "Some text", text)
+	assert.Equal(t, []tg_md2html.MessageEntity{{Type: tg_md2html.EntityBold, Offset: 5, Length: 4}}, entities)
+	assert.Equal(t, []tg_md2html.ButtonV2{{Name: "hello", Type: "url", Content: "example.com"}}, btns)
+}
+
+func TestMD2EntitiesV2StripsText(t *testing.T) {
+	// The entity text should always match the stripped markdown.
+	for _, x := range stripMD {
+		text, _ := tg_md2html.MD2EntitiesV2(x.in)
+		assert.Equal(t, tg_md2html.StripMDV2(x.in), text)
+	}
+}
+
+func TestHTML2EntitiesV2(t *testing.T) {
+	for _, x := range md2EntitiesV2 {
+		t.Run(x.in, func(t *testing.T) {
+			text, entities, err := tg_md2html.HTML2EntitiesV2(tg_md2html.MD2HTMLV2(x.in))
+			assert.NoError(t, err)
+			assert.Equal(t, x.text, text)
+			assert.Equal(t, x.entities, entities)
+		})
+	}
+
+	for _, x := range []struct {
+		in       string
+		text     string
+		entities []tg_md2html.MessageEntity
+	}{
+		{
+			in:   "<strong>bold</strong> <em>italic</em> <ins>underline</ins> <del>strike</del> <tg-spoiler>spoiler</tg-spoiler>",
+			text: "bold italic underline strike spoiler",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityBold, Offset: 0, Length: 4},
+				{Type: tg_md2html.EntityItalic, Offset: 5, Length: 6},
+				{Type: tg_md2html.EntityUnderline, Offset: 12, Length: 9},
+				{Type: tg_md2html.EntityStrikethrough, Offset: 22, Length: 6},
+				{Type: tg_md2html.EntitySpoiler, Offset: 29, Length: 7},
+			},
+		}, {
+			in:   `<pre><code class="language-go">x &lt; y</code></pre>`,
+			text: "x < y",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityPre, Offset: 0, Length: 5, Language: "go"},
+			},
+		}, {
+			in:   `<a href="example.com?a=1&amp;b=2">👍 link</a>`,
+			text: "👍 link",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityTextLink, Offset: 0, Length: 7, URL: "example.com?a=1&b=2"},
+			},
+		}, {
+			in:   `<blockquote expandable>quote</blockquote>`,
+			text: "quote",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityExpandableBlockquote, Offset: 0, Length: 5},
+			},
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			text, entities, err := tg_md2html.HTML2EntitiesV2(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, x.text, text)
+			assert.Equal(t, x.entities, entities)
+		})
+	}
+}
+
+func TestHTML2EntitiesV2_errors(t *testing.T) {
+	for _, in := range []string{
+		"<b>unclosed",
+		"<unknown>tag</unknown>",
+		`<span class="other">span</span>`,
+		`<tg-time unix="tomorrow">time</tg-time>`,
+		"<>",
+	} {
+		t.Run(in, func(t *testing.T) {
+			_, _, err := tg_md2html.HTML2EntitiesV2(in)
+			assert.Error(t, err)
+		})
+	}
+}
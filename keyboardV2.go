@@ -0,0 +1,98 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Telegram's limits on the size of an inline keyboard.
+const (
+	MaxKeyboardButtons  = 100
+	MaxKeyboardRowWidth = 8
+)
+
+var ErrInvalidKeyboard = errors.New("invalid keyboard")
+
+// InlineKeyboardMarkup is an inline keyboard, as sent to telegram in a message's reply_markup.
+// https://core.telegram.org/bots/api#inlinekeyboardmarkup
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// InlineKeyboardV2 lays out buttons into a keyboard, using the default converter.
+func InlineKeyboardV2(btns []ButtonV2) (*InlineKeyboardMarkup, error) {
+	return defaultConverterV2.InlineKeyboard(btns)
+}
+
+// InlineKeyboard lays out buttons into a keyboard, starting a new row for each button which isn't SameLine.
+// An empty list of buttons returns a nil keyboard.
+func (cv ConverterV2) InlineKeyboard(btns []ButtonV2) (*InlineKeyboardMarkup, error) {
+	if len(btns) == 0 {
+		return nil, nil
+	}
+
+	var rows [][]InlineKeyboardButton
+	for idx, btn := range btns {
+		ib, err := cv.InlineKeyboardButton(btn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid button %d (%s): %w", idx, btn.Name, err)
+		}
+		if idx == 0 || !btn.SameLine {
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], ib)
+	}
+
+	kb := &InlineKeyboardMarkup{InlineKeyboard: rows}
+	if err := kb.Validate(); err != nil {
+		return nil, err
+	}
+	return kb, nil
+}
+
+// Buttons returns the keyboard's buttons, with SameLine set for all but the first button of each row. The result can
+// be passed to Reverse along with the message text.
+func (cv ConverterV2) Buttons(kb *InlineKeyboardMarkup) ([]ButtonV2, error) {
+	if kb == nil {
+		return nil, nil
+	}
+	if err := kb.Validate(); err != nil {
+		return nil, err
+	}
+
+	var btns []ButtonV2
+	for _, row := range kb.InlineKeyboard {
+		for idx, ib := range row {
+			btn, err := cv.Button(ib)
+			if err != nil {
+				return nil, fmt.Errorf("invalid button %d (%s): %w", len(btns), ib.Text, err)
+			}
+			btn.SameLine = idx > 0
+			btns = append(btns, btn)
+		}
+	}
+	return btns, nil
+}
+
+// Validate checks that the keyboard is within telegram's limits. Pay buttons must be the first button of the keyboard.
+func (kb *InlineKeyboardMarkup) Validate() error {
+	count := 0
+	for r, row := range kb.InlineKeyboard {
+		if len(row) == 0 {
+			return fmt.Errorf("%w: row %d is empty", ErrInvalidKeyboard, r)
+		}
+		if len(row) > MaxKeyboardRowWidth {
+			return fmt.Errorf("%w: row %d has %d buttons, the maximum is %d", ErrInvalidKeyboard, r, len(row), MaxKeyboardRowWidth)
+		}
+		for c, ib := range row {
+			if ib.Pay && (r != 0 || c != 0) {
+				return fmt.Errorf("%w: pay button %q must be the first button", ErrInvalidKeyboard, ib.Text)
+			}
+		}
+		count += len(row)
+	}
+	if count > MaxKeyboardButtons {
+		return fmt.Errorf("%w: %d buttons, the maximum is %d", ErrInvalidKeyboard, count, MaxKeyboardButtons)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tg_md2html_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestInlineKeyboardV2(t *testing.T) {
+	cv := testConverter()
+	in := "Welcome\n[Rules](buttoncb://rules)\n[Site](buttonurl#success://example.com)\n[Copy](buttoncopy://code:same)\n[Share](buttonswitch://:same)"
+	txt, btns := cv.MD2HTMLButtons(in)
+
+	kb, err := cv.InlineKeyboard(btns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	out, err := json.Marshal(kb)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"inline_keyboard": [
+		[{"text": "Rules", "callback_data": "rules"}],
+		[
+			{"text": "Site", "style": "success", "url": "example.com"},
+			{"text": "Copy", "copy_text": {"text": "code"}},
+			{"text": "Share", "switch_inline_query": ""}
+		]
+	]}`, string(out))
+
+	// A keyboard received from telegram converts back to the same buttons, and so to the same markdown.
+	var received tg_md2html.InlineKeyboardMarkup
+	assert.NoError(t, json.Unmarshal(out, &received))
+	btns2, err := cv.Buttons(&received)
+	assert.NoError(t, err)
+	assert.Equal(t, btns, btns2)
+
+	md, err := cv.Reverse(txt, btns2)
+	assert.NoError(t, err)
+	assert.Equal(t, in, md)
+}
+
+func TestInlineKeyboardV2_errors(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		in   string
+		err  error
+	}{
+		{
+			name: "too many buttons",
+			in:   strings.Repeat("[a](buttonurl://example.com)\n", 101),
+			err:  tg_md2html.ErrInvalidKeyboard,
+		}, {
+			name: "row too wide",
+			in:   "[a](buttonurl://example.com)" + strings.Repeat("[a](buttonurl://example.com:same)", 8),
+			err:  tg_md2html.ErrInvalidKeyboard,
+		}, {
+			name: "pay not first",
+			in:   "[a](buttonurl://example.com)\n[Pay](buttonpay://)",
+			err:  tg_md2html.ErrInvalidKeyboard,
+		}, {
+			name: "invalid button",
+			in:   "[a](buttonwebapp://example.com)",
+			err:  tg_md2html.ErrInvalidButton,
+		}, {
+			name: "not an inline button",
+			in:   "[a](buttontext://some text)",
+			err:  tg_md2html.ErrInvalidButton,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			_, btns := testConverter().MD2HTMLButtons(x.in)
+			_, err := testConverter().InlineKeyboard(btns)
+			assert.ErrorIs(t, err, x.err)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package tg_md2html
+
+import (
+	"fmt"
+)
+
+// Limits bounds the resources used to parse a single message, to protect against adversarial input.
+// A zero value means no limit.
+type Limits struct {
+	// MaxDepth is the maximum number of entities nested inside each other.
+	MaxDepth int
+	// MaxEntities is the maximum number of entities and buttons in a message.
+	MaxEntities int
+	// MaxInputRunes is the maximum length of the input, in runes.
+	MaxInputRunes int
+	// MaxWork is the maximum number of steps taken to parse the input. Parsing takes a few steps per rune of input, so
+	// this should be set to a small multiple of MaxInputRunes.
+	MaxWork int
+}
+
+// LimitKind is the name of one of the Limits.
+type LimitKind string
+
+const (
+	LimitDepth      LimitKind = "depth"       // Limits.MaxDepth
+	LimitEntities   LimitKind = "entities"    // Limits.MaxEntities
+	LimitInputRunes LimitKind = "input_runes" // Limits.MaxInputRunes
+	LimitWork       LimitKind = "work"        // Limits.MaxWork
+)
+
+// LimitError is returned when the input goes over one of the converter's Limits.
+type LimitError struct {
+	Limit LimitKind
+	// Max is the configured value of the limit.
+	Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("markdown exceeds %s limit of %d", e.Limit, e.Max)
+}
+
+// checkLimit sets the parser's error if the value is over the max, and reports whether the parse can continue.
+func (p *parserV2) checkLimit(limit LimitKind, value int, max int) bool {
+	if p.err == nil && max > 0 && value > max {
+		p.err = &LimitError{Limit: limit, Max: max}
+	}
+	return p.err == nil
+}
+
+// step counts one step of parsing work, and reports whether the parse can continue.
+func (p *parserV2) step() bool {
+	p.work++
+	return p.checkLimit(LimitWork, p.work, p.cv.Limits.MaxWork)
+}
+
+// newEntity counts an entity, and reports whether the parse can continue.
+func (p *parserV2) newEntity() bool {
+	p.entities++
+	return p.checkLimit(LimitEntities, p.entities, p.cv.Limits.MaxEntities)
+}
+
+// plainDocument is used in place of the parsed document when a limit is hit; the input is kept as plain text.
+func plainDocument(in string) *Document {
+	return &Document{Nodes: trimNodes([]Node{&Text{Value: in}})}
+}
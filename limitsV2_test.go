@@ -0,0 +1,74 @@
+package tg_md2html_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestLimitsV2(t *testing.T) {
+	for _, x := range []struct {
+		name   string
+		limits tg_md2html.Limits
+		in     string
+		out    string
+		err    *tg_md2html.LimitError
+	}{
+		{
+			name:   "within limits",
+			limits: tg_md2html.Limits{MaxDepth: 2, MaxEntities: 2, MaxInputRunes: 20, MaxWork: 100},
+			in:     "*bold _italic_*",
+			out:    "<b>bold <i>italic</i></b>",
+		}, {
+			name:   "depth",
+			limits: tg_md2html.Limits{MaxDepth: 2},
+			in:     ">*bold _italic_*",
+			out:    "&gt;*bold _italic_*",
+			err:    &tg_md2html.LimitError{Limit: tg_md2html.LimitDepth, Max: 2},
+		}, {
+			name:   "entities",
+			limits: tg_md2html.Limits{MaxEntities: 2},
+			in:     "*a* _b_ `c`",
+			out:    "*a* _b_ `c`",
+			err:    &tg_md2html.LimitError{Limit: tg_md2html.LimitEntities, Max: 2},
+		}, {
+			name:   "input runes",
+			limits: tg_md2html.Limits{MaxInputRunes: 5},
+			in:     "*<é👍>*",
+			out:    "*&lt;é👍&gt;*",
+			err:    &tg_md2html.LimitError{Limit: tg_md2html.LimitInputRunes, Max: 5},
+		}, {
+			name:   "work",
+			limits: tg_md2html.Limits{MaxWork: 1000},
+			in:     strings.Repeat("*a ", 1000) + "b",
+			out:    strings.Repeat("*a ", 1000) + "b",
+			err:    &tg_md2html.LimitError{Limit: tg_md2html.LimitWork, Max: 1000},
+		}, {
+			// Looking for the end of each delimiter is counted as work.
+			name:   "delimiter runs",
+			limits: tg_md2html.Limits{MaxWork: 100000, MaxInputRunes: 50000},
+			in:     strings.Repeat("*", 40000),
+			out:    strings.Repeat("*", 40000),
+			err:    &tg_md2html.LimitError{Limit: tg_md2html.LimitWork, Max: 100000},
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			cv := tg_md2html.ConverterV2{Limits: x.limits}
+			assert.Equal(t, x.out, cv.MD2HTML(x.in))
+
+			out, _, err := cv.MD2HTMLStrict(x.in)
+			if x.err == nil {
+				assert.NoError(t, err)
+				assert.Equal(t, x.out, out)
+				return
+			}
+			assert.Equal(t, x.err, err)
+
+			_, err = cv.Parse(x.in)
+			assert.Equal(t, x.err, err)
+		})
+	}
+}
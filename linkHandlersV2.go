@@ -0,0 +1,329 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LinkHandler parses and renders a special ![text](url) link, such as the built-in tg://emoji? and tg://time? links.
+// Handlers are registered in ConverterV2.LinkHandlers, by the URL prefix they handle.
+type LinkHandler interface {
+	// Parse parses and validates the link's URL. If an error is returned, the link is kept as plain text.
+	Parse(url string) (any, error)
+	// URL returns the link's URL, to write it back to markdown.
+	URL(data any) string
+	// HTML returns the name and attributes of the HTML tag wrapping the link's text; eg "tg-emoji", `emoji-id="1"`.
+	HTML(data any) (tag string, attrs string)
+	// ParseHTML returns the link's data from an HTML tag, if it is the handler's. attr returns the unescaped value of
+	// one of the tag's attributes.
+	ParseHTML(tag string, attr func(name string) (string, bool)) (any, bool)
+	// Entity returns the message entity for the link. Its offset and length are filled in by the converter.
+	Entity(data any) MessageEntity
+	// ParseEntity returns the link's data from a message entity, if it is the handler's.
+	ParseEntity(e MessageEntity) (any, bool)
+}
+
+// SpecialLink is a ![text](url) link parsed by one of the converter's LinkHandlers.
+type SpecialLink struct {
+	Handler LinkHandler
+	// Data is the value returned by the handler's Parse.
+	Data     any
+	Children []Node
+}
+
+func (*SpecialLink) node() {}
+
+// builtinLinkHandlers handle telegram's own special links. A converter's LinkHandlers can override them by using the
+// same prefix, or remove them with a nil handler.
+var builtinLinkHandlers = map[string]LinkHandler{
+	"tg://emoji?": CustomEmojiHandler{},
+	"tg://time?":  TimeHandler{},
+}
+
+var (
+	builtinLinkPrefixes       = linkPrefixes(builtinLinkHandlers)
+	builtinSortedLinkHandlers = sortLinkHandlers(builtinLinkHandlers)
+)
+
+// linkHandlers returns the converter's handlers, including the built-in ones which it doesn't override or remove.
+func (cv ConverterV2) linkHandlers() map[string]LinkHandler {
+	if len(cv.LinkHandlers) == 0 {
+		return builtinLinkHandlers
+	}
+	handlers := maps.Clone(builtinLinkHandlers)
+	for prefix, h := range cv.LinkHandlers {
+		if h == nil {
+			delete(handlers, prefix)
+		} else {
+			handlers[prefix] = h
+		}
+	}
+	return handlers
+}
+
+// linkPrefixes returns the URL prefixes of all the special links known by the converter.
+func (cv ConverterV2) linkPrefixes() [][]rune {
+	if len(cv.LinkHandlers) == 0 {
+		return builtinLinkPrefixes
+	}
+	return linkPrefixes(cv.linkHandlers())
+}
+
+func linkPrefixes(handlers map[string]LinkHandler) [][]rune {
+	prefixes := make([][]rune, 0, len(handlers))
+	for _, prefix := range slices.Sorted(maps.Keys(handlers)) {
+		prefixes = append(prefixes, []rune(html.EscapeString(prefix)))
+	}
+	return prefixes
+}
+
+// getLinkHandler returns the handler with the longest prefix matching the link, if any.
+func (cv ConverterV2) getLinkHandler(link string) (LinkHandler, bool) {
+	var handler LinkHandler
+	longest := -1
+	for prefix, h := range cv.linkHandlers() {
+		if len(prefix) > longest && strings.HasPrefix(link, prefix) {
+			handler, longest = h, len(prefix)
+		}
+	}
+	return handler, handler != nil
+}
+
+// sortedLinkHandlers returns the converter's handlers, ordered by prefix, so that they are always tried in the same
+// order.
+func (cv ConverterV2) sortedLinkHandlers() []LinkHandler {
+	if len(cv.LinkHandlers) == 0 {
+		return builtinSortedLinkHandlers
+	}
+	return sortLinkHandlers(cv.linkHandlers())
+}
+
+func sortLinkHandlers(handlers map[string]LinkHandler) []LinkHandler {
+	sorted := make([]LinkHandler, 0, len(handlers))
+	for _, prefix := range slices.Sorted(maps.Keys(handlers)) {
+		sorted = append(sorted, handlers[prefix])
+	}
+	return sorted
+}
+
+// parseSpecialHTML returns the special link for an HTML tag, from the first handler which claims it.
+func (cv ConverterV2) parseSpecialHTML(tagType string, tagContent string) (LinkHandler, any, bool) {
+	attr := func(name string) (string, bool) {
+		return getHTMLAttr(tagContent, name)
+	}
+	for _, h := range cv.sortedLinkHandlers() {
+		if data, ok := h.ParseHTML(tagType, attr); ok {
+			return h, data, true
+		}
+	}
+	return nil, nil, false
+}
+
+// parseSpecialEntity returns the special link for a message entity, from the first handler which claims it.
+func (cv ConverterV2) parseSpecialEntity(e MessageEntity) (LinkHandler, any, bool) {
+	for _, h := range cv.sortedLinkHandlers() {
+		if data, ok := h.ParseEntity(e); ok {
+			return h, data, true
+		}
+	}
+	return nil, nil, false
+}
+
+// parseSpecialLink parses the URL of a ![text](url) link with one of the converter's handlers, without its children.
+// Problems which don't stop the link from being used are added as diagnostics at offset.
+func (p *parserV2) parseSpecialLink(offset int, content string) (Node, *linkFailure) {
+	link := html.UnescapeString(content)
+	h, ok := p.cv.getLinkHandler(link)
+	if !ok {
+		return nil, &linkFailure{}
+	}
+	data, err := h.Parse(link)
+	if err != nil {
+		var failure *linkFailure
+		if errors.As(err, &failure) {
+			return nil, failure
+		}
+		return nil, &linkFailure{kind: DiagnosticBadSpecialLink, message: "invalid link " + link + ": " + err.Error()}
+	}
+	if c, ok := h.(linkChecker); ok {
+		if warning := c.check(data); warning != nil {
+			p.addDiagnostic(offset, warning.kind, "%s", warning.message)
+		}
+	}
+	return newSpecialLink(h, data, nil), nil
+}
+
+// linkFailure describes why a special link couldn't be parsed. The built-in handlers return it from Parse, to set the
+// kind of diagnostic.
+type linkFailure struct {
+	kind    DiagnosticKind
+	message string
+}
+
+func (f *linkFailure) Error() string {
+	return f.message
+}
+
+// linkChecker is implemented by the built-in handlers, to report problems which don't stop a link from being used.
+type linkChecker interface {
+	check(data any) *linkFailure
+}
+
+// newSpecialLink returns the node for a special link. The built-in handlers' data is a node without children, so that
+// custom emoji and times keep their own node types.
+func newSpecialLink(h LinkHandler, data any, children []Node) Node {
+	switch h.(type) {
+	case CustomEmojiHandler:
+		return &CustomEmoji{ID: data.(*CustomEmoji).ID, Children: children}
+	case TimeHandler:
+		t := data.(*Time)
+		return &Time{Unix: t.Unix, Format: t.Format, Children: children}
+	}
+	return &SpecialLink{Handler: h, Data: data, Children: children}
+}
+
+// specialLink returns the handler, data and children of a special link node, including custom emoji and times.
+func specialLink(n Node) (LinkHandler, any, []Node) {
+	switch n := n.(type) {
+	case *CustomEmoji:
+		return CustomEmojiHandler{}, n, n.Children
+	case *Time:
+		return TimeHandler{}, n, n.Children
+	case *SpecialLink:
+		return n.Handler, n.Data, n.Children
+	}
+	return nil, nil, nil
+}
+
+// CustomEmojiHandler is the built-in handler for ![👍](tg://emoji?id=5368324170671202286) links. Its data is a
+// *CustomEmoji, and its links are parsed as CustomEmoji nodes.
+type CustomEmojiHandler struct{}
+
+func (CustomEmojiHandler) Parse(link string) (any, error) {
+	_, query, _ := strings.Cut(link, "?")
+	queryForm, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, &linkFailure{kind: DiagnosticBadEmojiID, message: "invalid emoji query: " + err.Error()}
+	}
+
+	id := queryForm.Get("id")
+	if id == "" {
+		return nil, &linkFailure{kind: DiagnosticBadEmojiID, message: "missing emoji id"}
+	}
+	return &CustomEmoji{ID: id}, nil
+}
+
+func (CustomEmojiHandler) check(data any) *linkFailure {
+	id := data.(*CustomEmoji).ID
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return &linkFailure{kind: DiagnosticBadEmojiID, message: fmt.Sprintf("emoji id %q is not a number", id)}
+	}
+	return nil
+}
+
+func (CustomEmojiHandler) URL(data any) string {
+	return "tg://emoji?id=" + data.(*CustomEmoji).ID
+}
+
+func (CustomEmojiHandler) HTML(data any) (string, string) {
+	return "tg-emoji", `emoji-id="` + html.EscapeString(data.(*CustomEmoji).ID) + `"`
+}
+
+func (CustomEmojiHandler) ParseHTML(tag string, attr func(name string) (string, bool)) (any, bool) {
+	if tag != "tg-emoji" {
+		return nil, false
+	}
+	id, ok := attr("emoji-id")
+	if !ok {
+		return nil, false
+	}
+	return &CustomEmoji{ID: id}, true
+}
+
+func (CustomEmojiHandler) Entity(data any) MessageEntity {
+	return MessageEntity{Type: EntityCustomEmoji, CustomEmojiID: data.(*CustomEmoji).ID}
+}
+
+func (CustomEmojiHandler) ParseEntity(e MessageEntity) (any, bool) {
+	if e.Type != EntityCustomEmoji {
+		return nil, false
+	}
+	return &CustomEmoji{ID: e.CustomEmojiID}, true
+}
+
+// TimeHandler is the built-in handler for ![22:45 tomorrow](tg://time?unix=1647531900&format=wDT) links. Its data is
+// a *Time, and its links are parsed as Time nodes.
+type TimeHandler struct{}
+
+func (TimeHandler) Parse(link string) (any, error) {
+	_, query, _ := strings.Cut(link, "?")
+	queryForm, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, &linkFailure{kind: DiagnosticBadTimeQuery, message: "invalid time query: " + err.Error()}
+	}
+
+	unix, err := strconv.ParseInt(queryForm.Get("unix"), 10, 64)
+	if err != nil {
+		return nil, &linkFailure{kind: DiagnosticBadTimeQuery, message: fmt.Sprintf("invalid unix time %q", queryForm.Get("unix"))}
+	}
+	return &Time{Unix: unix, Format: queryForm.Get("format")}, nil
+}
+
+func (TimeHandler) check(data any) *linkFailure {
+	if format := data.(*Time).Format; !validTimeFormat(format) {
+		return &linkFailure{kind: DiagnosticBadTimeQuery, message: fmt.Sprintf("invalid time format %q", format)}
+	}
+	return nil
+}
+
+func (TimeHandler) URL(data any) string {
+	t := data.(*Time)
+	unix := strconv.FormatInt(t.Unix, 10)
+	if t.Format != "" {
+		return "tg://time?unix=" + unix + "&format=" + t.Format
+	}
+	return "tg://time?unix=" + unix
+}
+
+func (TimeHandler) HTML(data any) (string, string) {
+	t := data.(*Time)
+	attrs := `unix="` + strconv.FormatInt(t.Unix, 10) + `"`
+	if t.Format != "" {
+		attrs += ` format="` + html.EscapeString(t.Format) + `"`
+	}
+	return "tg-time", attrs
+}
+
+func (TimeHandler) ParseHTML(tag string, attr func(name string) (string, bool)) (any, bool) {
+	if tag != "tg-time" {
+		return nil, false
+	}
+	unix, ok := attr("unix")
+	if !ok {
+		return nil, false
+	}
+	unixTime, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	format, _ := attr("format")
+	return &Time{Unix: unixTime, Format: format}, true
+}
+
+func (TimeHandler) Entity(data any) MessageEntity {
+	t := data.(*Time)
+	return MessageEntity{Type: EntityDateTime, UnixTime: t.Unix, DateTimeFormat: t.Format}
+}
+
+func (TimeHandler) ParseEntity(e MessageEntity) (any, bool) {
+	if e.Type != EntityDateTime {
+		return nil, false
+	}
+	return &Time{Unix: e.UnixTime, Format: e.DateTimeFormat}, true
+}
@@ -0,0 +1,149 @@
+package tg_md2html_test
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+// stockHandler handles ![text](tg://stock?symbol=AAPL) links.
+type stockHandler struct{}
+
+const stockPrefix = "tg://stock?symbol="
+
+func (stockHandler) Parse(url string) (any, error) {
+	symbol := strings.TrimPrefix(url, stockPrefix)
+	if symbol == "" || strings.ToUpper(symbol) != symbol {
+		return nil, errors.New("symbol must be uppercase")
+	}
+	return symbol, nil
+}
+
+func (stockHandler) URL(data any) string {
+	return stockPrefix + data.(string)
+}
+
+func (stockHandler) HTML(data any) (string, string) {
+	return "tg-stock", `symbol="` + html.EscapeString(data.(string)) + `"`
+}
+
+func (stockHandler) ParseHTML(tag string, attr func(name string) (string, bool)) (any, bool) {
+	if tag != "tg-stock" {
+		return nil, false
+	}
+	return attr("symbol")
+}
+
+func (stockHandler) Entity(data any) tg_md2html.MessageEntity {
+	return tg_md2html.MessageEntity{Type: "stock", URL: stockPrefix + data.(string)}
+}
+
+func (stockHandler) ParseEntity(e tg_md2html.MessageEntity) (any, bool) {
+	if e.Type != "stock" || !strings.HasPrefix(e.URL, stockPrefix) {
+		return nil, false
+	}
+	return strings.TrimPrefix(e.URL, stockPrefix), true
+}
+
+func stockConverter() *tg_md2html.ConverterV2 {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.LinkHandlers = map[string]tg_md2html.LinkHandler{"tg://stock?": stockHandler{}}
+	return cv
+}
+
+func TestLinkHandlersV2(t *testing.T) {
+	cv := stockConverter()
+	for _, x := range []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "simple",
+			in:   "Buy ![Apple](tg://stock?symbol=AAPL) now",
+			out:  `Buy <tg-stock symbol="AAPL">Apple</tg-stock> now`,
+		}, {
+			name: "formatted",
+			in:   "*![_Apple_](tg://stock?symbol=AAPL)*",
+			out:  `<b><tg-stock symbol="AAPL"><i>Apple</i></tg-stock></b>`,
+		}, {
+			name: "builtins still work",
+			in:   "![👍](tg://emoji?id=5368324170671202286) ![Apple](tg://stock?symbol=AAPL)",
+			out:  `<tg-emoji emoji-id="5368324170671202286">👍</tg-emoji> <tg-stock symbol="AAPL">Apple</tg-stock>`,
+		}, {
+			// As with the built-in links, handled URLs can't be used in regular links.
+			name: "regular link",
+			in:   "[Apple](tg://stock?symbol=AAPL)",
+			out:  "[Apple](tg://stock?symbol=AAPL)",
+		}, {
+			name: "no code inside",
+			in:   "![`AAPL`](tg://stock?symbol=AAPL)",
+			out:  `<tg-stock symbol="AAPL">AAPL</tg-stock>`,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.out, cv.MD2HTML(x.in))
+
+			out, err := cv.Reverse(x.out, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, cv.MD2HTML(out))
+
+			text, entities := cv.MD2Entities(x.in)
+			out, err = cv.ReverseEntities(text, entities, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, cv.MD2HTML(out))
+		})
+	}
+}
+
+func TestLinkHandlersV2Entities(t *testing.T) {
+	text, entities := stockConverter().MD2Entities("Buy ![Apple](tg://stock?symbol=AAPL)")
+	assert.Equal(t, "Buy Apple", text)
+	assert.Equal(t, []tg_md2html.MessageEntity{
+		{Type: "stock", Offset: 4, Length: 5, URL: "tg://stock?symbol=AAPL"},
+	}, entities)
+}
+
+func TestLinkHandlersV2Invalid(t *testing.T) {
+	out, diags, err := stockConverter().MD2HTMLStrict("Buy ![Apple](tg://stock?symbol=aapl)")
+	assert.NoError(t, err)
+	assert.Equal(t, "Buy ![Apple](tg://stock?symbol=aapl)", out)
+	if assert.Len(t, diags, 1) {
+		assert.Equal(t, tg_md2html.DiagnosticBadSpecialLink, diags[0].Kind)
+		assert.Equal(t, 4, diags[0].Offset)
+	}
+
+	// Without the handler, the link isn't special.
+	assert.Equal(t, "Buy ![Apple](tg://stock?symbol=AAPL)", tg_md2html.MD2HTMLV2("Buy ![Apple](tg://stock?symbol=AAPL)"))
+}
+
+// plainTimeHandler replaces the built-in time links, rendering them as bold text.
+type plainTimeHandler struct {
+	tg_md2html.TimeHandler
+}
+
+func (plainTimeHandler) HTML(any) (string, string) {
+	return "b", ""
+}
+
+func TestLinkHandlersV2Builtin(t *testing.T) {
+	in := "![👍](tg://emoji?id=1) at ![noon](tg://time?unix=1647531900)"
+	assert.Equal(t, `<tg-emoji emoji-id="1">👍</tg-emoji> at <tg-time unix="1647531900">noon</tg-time>`, stockConverter().MD2HTML(in))
+
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.LinkHandlers = map[string]tg_md2html.LinkHandler{
+		"tg://emoji?": nil,
+		"tg://time?":  plainTimeHandler{},
+	}
+	assert.Equal(t, "![👍](tg://emoji?id=1)", cv.MD2HTML("![👍](tg://emoji?id=1)"))
+	assert.Equal(t, `at <b>noon</b>`, cv.MD2HTML("at ![noon](tg://time?unix=1647531900)"))
+
+	// The built-in handlers can be used with other prefixes too.
+	cv.LinkHandlers = map[string]tg_md2html.LinkHandler{"tg://e?": tg_md2html.CustomEmojiHandler{}}
+	assert.Equal(t, `<tg-emoji emoji-id="2">👍</tg-emoji>`, cv.MD2HTML("![👍](tg://e?id=2)"))
+}
@@ -0,0 +1,121 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// LinkPolicy controls which link URLs a converter accepts, and how they are normalised. It applies to text links and
+// to the content of url buttons; mentions, custom emoji and times are checked separately.
+type LinkPolicy struct {
+	// Schemes lists the allowed URL schemes, eg "https" and "tg". If empty, any scheme is allowed.
+	Schemes []string
+	// AddHTTPS prefixes https:// to URLs without a scheme which start with a domain name, such as github.com.
+	AddHTTPS bool
+	// Punycode converts internationalised domain names to their lowercase ASCII form, eg xn--bcher-kva.example. Hosts
+	// are first normalised as in a DNS lookup, so that eg fullwidth ＧＯＯＧＬＥ.com becomes google.com.
+	Punycode bool
+	// Rewrite, if set, is called with each normalised URL. It returns the URL to use, or an error to reject the link.
+	Rewrite func(url string) (string, error)
+}
+
+var ErrRejectedLink = errors.New("rejected link")
+
+// CheckURL applies the converter's LinkPolicy to a URL, returning the URL to use. If the converter has no LinkPolicy,
+// the URL is returned as-is.
+func (cv ConverterV2) CheckURL(link string) (string, error) {
+	if cv.LinkPolicy == nil {
+		return link, nil
+	}
+	return cv.LinkPolicy.Apply(link)
+}
+
+// Apply checks a URL against the policy, and returns its normalised form.
+// URLs which are empty, contain spaces or control characters, or can't be parsed are always rejected.
+func (lp *LinkPolicy) Apply(link string) (string, error) {
+	if link == "" {
+		return "", fmt.Errorf("%w: empty URL", ErrRejectedLink)
+	}
+	if strings.IndexFunc(link, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return "", fmt.Errorf("%w: %q contains spaces or control characters", ErrRejectedLink, link)
+	}
+	if _, ok := bareDomain(link); lp.AddHTTPS && ok {
+		link = "https://" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %w", ErrRejectedLink, link, err)
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if len(lp.Schemes) > 0 && !slices.ContainsFunc(lp.Schemes, func(s string) bool { return strings.EqualFold(s, scheme) }) {
+		if scheme == "" {
+			return "", fmt.Errorf("%w: %q has no scheme", ErrRejectedLink, link)
+		}
+		return "", fmt.Errorf("%w: scheme %q is not allowed", ErrRejectedLink, scheme)
+	}
+	if (scheme == "http" || scheme == "https") && u.Host == "" {
+		return "", fmt.Errorf("%w: %q has no host", ErrRejectedLink, link)
+	}
+
+	if lp.Punycode && u.Host != "" && !strings.HasPrefix(u.Host, "[") {
+		host, err := idna.Lookup.ToASCII(u.Hostname())
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid host %q: %w", ErrRejectedLink, u.Hostname(), err)
+		}
+		if port := u.Port(); port != "" {
+			host += ":" + port
+		}
+		if host != u.Host {
+			u.Host = host
+			link = u.String()
+		}
+	}
+
+	if lp.Rewrite != nil {
+		rewritten, err := lp.Rewrite(link)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrRejectedLink, err)
+		}
+		link = rewritten
+	}
+	return link, nil
+}
+
+// idnDots are the full stop characters which separate the labels of an internationalised domain name.
+var idnDots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+// bareDomain returns the domain name at the start of a URL without a scheme; eg github.com for github.com/PaulSonOfLars.
+func bareDomain(link string) (string, bool) {
+	if strings.Contains(link, "://") {
+		return "", false
+	}
+	host, _, _ := strings.Cut(link, "/")
+	host, _, _ = strings.Cut(host, "?")
+	host, _, _ = strings.Cut(host, "#")
+	if h, port, ok := strings.Cut(host, ":"); ok {
+		if port == "" || strings.IndexFunc(port, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+			return "", false // Not a port; this is a scheme, as in mailto:someone@example.com.
+		}
+		host = h
+	}
+
+	labels := strings.Split(idnDots.Replace(host), ".")
+	if len(labels) < 2 {
+		return "", false
+	}
+	for _, label := range labels {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") ||
+			strings.IndexFunc(label, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' }) >= 0 {
+			return "", false
+		}
+	}
+	// Top level domains always have a letter, which tells domains apart from IP addresses.
+	return host, strings.IndexFunc(labels[len(labels)-1], unicode.IsLetter) >= 0
+}
@@ -0,0 +1,163 @@
+package tg_md2html_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func policyConverter() *tg_md2html.ConverterV2 {
+	cv := tg_md2html.NewV2(map[string]string{tg_md2html.ButtonTypeURL: "buttonurl"}, nil)
+	cv.LinkPolicy = &tg_md2html.LinkPolicy{
+		Schemes:  []string{"https", "http", "tg"},
+		AddHTTPS: true,
+		Punycode: true,
+		Rewrite: func(url string) (string, error) {
+			if strings.Contains(url, "spam.example") {
+				return "", errors.New("spam")
+			}
+			return strings.Replace(url, "http://", "https://", 1), nil
+		},
+	}
+	return cv
+}
+
+func TestLinkPolicyV2(t *testing.T) {
+	cv := policyConverter()
+	for _, x := range []struct {
+		name     string
+		in       string
+		out      string
+		rejected bool
+	}{
+		{
+			name: "allowed",
+			in:   "[link](https://example.com)",
+			out:  `<a href="https://example.com">link</a>`,
+		}, {
+			name: "bare domain",
+			in:   "[links [with square brackets!]](github.com)",
+			out:  `<a href="https://github.com">links [with square brackets!]</a>`,
+		}, {
+			name: "idn",
+			in:   "[books](https://Bücher.example/?q=1)",
+			out:  `<a href="https://xn--bcher-kva.example/?q=1">books</a>`,
+		}, {
+			name: "rewritten",
+			in:   "[link](http://example.com)",
+			out:  `<a href="https://example.com">link</a>`,
+		}, {
+			name:     "javascript",
+			in:       "[click](javascript:alert(1\\))",
+			out:      "[click](javascript:alert(1))",
+			rejected: true,
+		}, {
+			name:     "data",
+			in:       "*[click](data:text/html,hi)*",
+			out:      "<b>[click](data:text/html,hi)</b>",
+			rejected: true,
+		}, {
+			name:     "spaces",
+			in:       "[click](https://example.com/a b)",
+			out:      "[click](https://example.com/a b)",
+			rejected: true,
+		}, {
+			name:     "rejected by rewrite",
+			in:       "[free](https://spam.example)",
+			out:      "[free](https://spam.example)",
+			rejected: true,
+		}, {
+			name: "mentions aren't checked",
+			in:   "[someone](tg://user?id=123)",
+			out:  `<a href="tg://user?id=123">someone</a>`,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			out, diags, err := cv.MD2HTMLStrict(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, out)
+			if x.rejected && assert.Len(t, diags, 1) {
+				assert.Equal(t, tg_md2html.DiagnosticRejectedLink, diags[0].Kind)
+			}
+		})
+	}
+}
+
+func TestLinkPolicyV2Buttons(t *testing.T) {
+	cv := policyConverter()
+
+	out, btns := cv.MD2HTMLButtons("Hi\n[Repo](buttonurl://github.com/PaulSonOfLars)\n[Bad](buttonurl://file:///etc/passwd)")
+	assert.Equal(t, "Hi\n\n[Bad](buttonurl://file:///etc/passwd)", out)
+	assert.Equal(t, []tg_md2html.ButtonV2{{
+		Name:    "Repo",
+		Type:    tg_md2html.ButtonTypeURL,
+		Content: "https://github.com/PaulSonOfLars",
+	}}, btns)
+
+	_, err := cv.InlineKeyboardButton(tg_md2html.ButtonV2{Name: "Bad", Type: tg_md2html.ButtonTypeURL, Content: "javascript:alert(1)"})
+	assert.ErrorIs(t, err, tg_md2html.ErrRejectedLink)
+}
+
+func TestLinkPolicyV2NoPolicy(t *testing.T) {
+	assert.Equal(t, `<a href="github.com">link</a>`, tg_md2html.MD2HTMLV2("[link](github.com)"))
+
+	link, err := tg_md2html.NewV2(nil, nil).CheckURL("javascript:alert(1)")
+	assert.NoError(t, err)
+	assert.Equal(t, "javascript:alert(1)", link)
+}
+
+func TestLinkPolicyV2Apply(t *testing.T) {
+	lp := tg_md2html.LinkPolicy{Schemes: []string{"https"}}
+	for _, in := range []string{"", "github.com", "https://", "HTTP://example.com", "https://exa mple.com", "https://example.com/\x00"} {
+		_, err := lp.Apply(in)
+		assert.ErrorIs(t, err, tg_md2html.ErrRejectedLink, in)
+	}
+
+	link, err := lp.Apply("HTTPS://example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTPS://example.com", link)
+}
+
+func TestLinkPolicyV2Punycode(t *testing.T) {
+	lp := tg_md2html.LinkPolicy{Punycode: true}
+	for in, out := range map[string]string{
+		// Examples from RFC 3492 and common IDN test vectors.
+		"https://bücher.example/path":    "https://xn--bcher-kva.example/path",
+		"https://münchen.de":             "https://xn--mnchen-3ya.de",
+		"https://пример.испытание/":      "https://xn--e1afmkfd.xn--80akhbyknj4f/",
+		"https://☃.net":                  "https://xn--n3h.net",
+		"https://例え.テスト":                 "https://xn--r8jz45g.xn--zckzah",
+		"https://MAÑANA.com:8443/?q=1":   "https://xn--maana-pta.com:8443/?q=1",
+		"https://bücher。example":         "https://xn--bcher-kva.example",
+		"https://Example.COM/Path":       "https://example.com/Path",
+		"https://example.com/ü":          "https://example.com/ü",
+		"https://[::1]:8080/":            "https://[::1]:8080/",
+		"tg://resolve?domain=someone":    "tg://resolve?domain=someone",
+		"https://xn--bcher-kva.example/": "https://xn--bcher-kva.example/",
+		// Hosts are normalised first: fullwidth characters, other full stops, and decomposed accents.
+		"https://ＧＯＯＧＬＥ.com/x":         "https://google.com/x",
+		"https://ｇｉｔｈｕｂ．ｃｏｍ":           "https://github.com",
+		"https://e\u0301.com":          "https://xn--9ca.com",
+		"https://bu\u0308cher.example": "https://xn--bcher-kva.example",
+	} {
+		t.Run(in, func(t *testing.T) {
+			got, err := lp.Apply(in)
+			assert.NoError(t, err)
+			assert.Equal(t, out, got)
+		})
+	}
+}
+
+func TestLinkPolicyV2PunycodeInvalid(t *testing.T) {
+	lp := tg_md2html.LinkPolicy{Punycode: true}
+	for _, in := range []string{"https://-bad.example", "https://xn--a.example"} {
+		t.Run(in, func(t *testing.T) {
+			_, err := lp.Apply(in)
+			assert.ErrorIs(t, err, tg_md2html.ErrRejectedLink)
+		})
+	}
+}
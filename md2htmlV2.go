@@ -2,16 +2,15 @@ package tg_md2html
 
 import (
 	"html"
-	"net/url"
 	"slices"
-	"sort"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var defaultConverterV2 = ConverterV2{
 	Prefixes: map[string]string{
-		"url": "buttonurl",
+		ButtonTypeURL: "buttonurl",
 	},
 	Styles: map[string]string{
 		"primary": "primary",
@@ -21,35 +20,83 @@ var defaultConverterV2 = ConverterV2{
 	SameLineSuffix: sameLineSuffix,
 }
 
+// DefaultPrefixes returns a prefix for each of the built-in button types. The default converter only parses URL
+// buttons, so that the other prefixes are kept as links; set ConverterV2.Prefixes to use them.
+func DefaultPrefixes() map[string]string {
+	return map[string]string{
+		ButtonTypeURL:                          "buttonurl",
+		ButtonTypeCallback:                     "buttoncb",
+		ButtonTypeSwitchInlineQuery:            "buttonswitch",
+		ButtonTypeSwitchInlineQueryCurrentChat: "buttonswitchhere",
+		ButtonTypeCopyText:                     "buttoncopy",
+		ButtonTypeWebApp:                       "buttonwebapp",
+		ButtonTypeLoginURL:                     "buttonlogin",
+		ButtonTypePay:                          "buttonpay",
+	}
+}
+
 // ButtonV2 identifies a button.
 // The markdown syntax for a button is as such (where <> represents fields)
 // [<name>](<prefix>:<content>)
 // [<name>](<prefix>:<content>:<sameline>)
 // [<name>](<prefix>#<style>:<content>)
 // [<name>](<prefix>#<style>:<content>:<sameline>)
+// [<name>](<prefix>#<style>@<icon>:<content>:<sameline>)
 type ButtonV2 struct {
 	// Name of the button, defined by the user inside the []
 	Name string
-	// The type of the button - as determined by the "prefixes" in ConverterV2
+	// The type of the button - as determined by the "prefixes" in ConverterV2; see the ButtonType constants.
 	Type string
-	// The content of the button; a url, text, etc.
+	// The content of the button; a url, text, etc. Pay buttons have no content.
 	Content string
 	// Whether the button should be on the same line as the previous one.
 	SameLine bool
 	// According to telegram, one of: "danger" (red), "success" (green), or "primary" (blue).
 	// https://core.telegram.org/bots/api#keyboardbutton
 	Style string
+	// Icon is the ID of a custom emoji shown before the button's name.
+	Icon string
+	// Err is set when the content isn't valid for the button's type; see Validate.
+	Err error
 }
 
 type ConverterV2 struct {
 	// Prefixes determines how to map button types to button prefixes.
 	// Eg; "url": "buttonurl" creates a URL button when the prefix is "buttonurl"
+	// The default converter only has the URL prefix; see DefaultPrefixes for the other button types.
 	Prefixes map[string]string
 	// Styles determines how to map style names to the relevant telegram value.
 	// Eg: "primary": "primary" just enabled "primary" style.
 	// Eg: "green": "success" would allow users to use "green" as an alias for "success"
 	Styles         map[string]string
 	SameLineSuffix string
+	// ReplyPrefixes determines how to map reply keyboard button types to button prefixes, as with Prefixes.
+	// Eg; "request_contact": "replycontact" creates a contact request button when the prefix is "replycontact"
+	// Reply buttons are only parsed when this is set; see DefaultReplyPrefixes.
+	ReplyPrefixes map[string]string
+	// ReplyKeyboardPrefix is the prefix used to set the reply keyboard's options; see ReplyKeyboardOptions.
+	ReplyKeyboardPrefix string
+	// Directives determines how to map directives to the name used inside {}, as with Prefixes.
+	// Eg; "no_notification": "nonotif" sends the message silently when the text contains {nonotif}
+	// Directives are only parsed when this is set, in which case '{' can be escaped with \{; see DefaultDirectives.
+	Directives map[Directive]string
+	// LinkHandlers adds support for ![text](url) links, by the URL prefix they handle, on top of the built-in
+	// "tg://emoji?" and "tg://time?" handlers. The longest matching prefix is used.
+	// Eg; "tg://stock?": handler parses ![AAPL](tg://stock?symbol=AAPL) with handler.
+	// Eg; "tg://time?": nil stops time links from being parsed, so they are kept as text.
+	LinkHandlers map[string]LinkHandler
+	// Delimiters determines which inline delimiters exist, and the entity each one creates; see Delimiters.Validate.
+	// Eg; "**": EntityBold uses **bold** like GitHub. If nil, DefaultDelimiters is used.
+	Delimiters Delimiters
+	// AllowedEntities, if set, restricts the entities in the output to those listed; eg only EntityBold, EntityItalic and
+	// EntityTextLink. Other entities are reduced to their contents, or kept as their markdown text if DisallowedAsText
+	// is set. This also applies to HTML and entities passed to Reverse.
+	AllowedEntities  map[EntityType]bool
+	DisallowedAsText bool
+	// LinkPolicy, if set, checks and normalises the URLs of links and url buttons; see LinkPolicy.
+	LinkPolicy *LinkPolicy
+	// Limits bounds the resources used to parse each message; see Limits.
+	Limits Limits
 }
 
 func NewV2(prefixes map[string]string, styles map[string]string) *ConverterV2 {
@@ -73,47 +120,84 @@ func MD2HTMLButtonsV2(in string) (string, []ButtonV2) {
 	return defaultConverterV2.MD2HTMLButtons(in)
 }
 
-var chars = map[string]string{
-	"`":    "code",
-	"```":  "pre",
-	"_":    "i",
-	"*":    "b",
-	"~":    "s",
-	"__":   "u",
-	"|":    "", // this is a placeholder for || to work
-	"||":   "span class=\"tg-spoiler\"",
-	"!":    "", // for emoji or datetime
-	"![":   "", // for emoji or datetime
-	"[":    "", // for links
-	"]":    "", // for links/emoji
-	"(":    "", // for links/emoji
-	")":    "", // for links/emoji
-	"\\":   "", // for escapes
-	"&":    "", // for blockquotes
-	"&gt;": "blockquote",
-}
-
-var AllMarkdownV2Chars = func() []rune {
-	var outString []string
-	for k := range chars {
-		outString = append(outString, k)
+func ConvertV2(in string) ResultV2 {
+	return defaultConverterV2.Convert(in)
+}
+
+// ResultV2 holds everything returned when converting markdown with Convert.
+type ResultV2 struct {
+	HTML    string
+	Buttons []ButtonV2
+	// ReplyButtons and ReplyOptions hold the reply keyboard defined in the text, if any; see ReplyKeyboard.
+	ReplyButtons []ButtonV2
+	ReplyOptions *ReplyKeyboardOptions
+	// Options holds the send options set by directives in the text.
+	Options MessageOptions
+	// Mentions holds the IDs of the users mentioned in the text, in the order they are first mentioned.
+	Mentions []int64
+}
+
+var AllMarkdownV2Chars = slices.Clone(defaultDelimiterSet.markdownChars)
+
+// Parse parses MarkdownV2 text into a Document. Buttons are parsed as Button nodes, as with MD2HTMLButtons.
+// Invalid markdown is never an error; unmatched delimiters are kept as text. A *LimitError is returned if the input
+// goes over the converter's Limits.
+func (cv ConverterV2) Parse(in string) (*Document, error) {
+	doc, _, err := cv.parseDiagnostics(in, true)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(outString)
-	var out []rune
-	for _, x := range outString {
-		out = append(out, []rune(x)[0])
+	return doc, nil
+}
+
+// parse parses the input. If it goes over the converter's Limits, it is kept as plain text instead.
+func (cv ConverterV2) parse(in string, enableButtons bool) *Document {
+	doc, _, err := cv.parseDiagnostics(in, enableButtons)
+	if err != nil {
+		return plainDocument(in)
+	}
+	return doc
+}
+
+// parseDiagnostics parses the input, and also returns any problems found along the way.
+func (cv ConverterV2) parseDiagnostics(in string, enableButtons bool) (*Document, []Diagnostic, error) {
+	p := parserV2{cv: cv, enableButtons: enableButtons, delims: cv.delimiters()}
+	if enableButtons {
+		p.directives, p.maxDirectiveLen = cv.directiveNames()
+	}
+	if !p.checkLimit(LimitInputRunes, utf8.RuneCountInString(in), cv.Limits.MaxInputRunes) {
+		return nil, nil, p.err
 	}
-	return out
-}()
+
+	runes, pos := escapeHTML(in)
+	nodes := p.md2html(newParseBuffer(runes, pos, cv.linkPrefixes(), &p.work))
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+	return &Document{Nodes: trimNodes(nodes)}, p.getDiagnostics([]rune(in)), nil
+}
 
 func (cv ConverterV2) MD2HTML(in string) string {
-	text, _ := cv.md2html([]rune(html.EscapeString(in)), false)
-	return strings.TrimSpace(text)
+	return cv.Render(cv.parse(in, false))
 }
 
 func (cv ConverterV2) MD2HTMLButtons(in string) (string, []ButtonV2) {
-	text, btns := cv.md2html([]rune(html.EscapeString(in)), true)
-	return strings.TrimSpace(text), btns
+	doc := cv.parse(in, true)
+	return cv.Render(doc), doc.Buttons()
+}
+
+// Convert converts markdown to HTML and buttons like MD2HTMLButtons, and also returns the users mentioned with
+// [name](tg://user?id=123) links.
+func (cv ConverterV2) Convert(in string) ResultV2 {
+	doc := cv.parse(in, true)
+	return ResultV2{
+		HTML:         cv.Render(doc),
+		Buttons:      doc.Buttons(),
+		ReplyButtons: doc.ReplyButtons(),
+		ReplyOptions: doc.ReplyKeyboardOptions(),
+		Options:      doc.Options(),
+		Mentions:     doc.Mentions(),
+	}
 }
 
 var skipStarts = map[rune]bool{
@@ -121,249 +205,581 @@ var skipStarts = map[rune]bool{
 	'[': true, // links
 }
 
-func getItem(in []rune, i int) (string, int, bool) {
-	c := in[i]
-	if _, ok := chars[string(c)]; !ok {
-		return "", 0, false
+// parseFrame holds the state for parsing a window of a parseBuffer; either the whole input, or the contents of an
+// entity. Frames are kept on an explicit stack rather than parsed recursively, so that deeply nested input can't
+// exhaust the goroutine stack.
+type parseFrame struct {
+	buf *parseBuffer
+	// lo and hi are the bounds of the window being parsed. lo moves forward after each entity, so that whatever follows
+	// an entity is parsed as though it was the start of the input.
+	lo, hi int
+	i      int
+	// entity is the type of the entity whose contents are being parsed, if any.
+	entity EntityType
+	// blockedBy holds, for each of nestingGroups, the innermost entity being parsed which can't contain that group, if
+	// any. This means nesting is checked in constant time, however deep the input is nested.
+	blockedBy [len(nestingGroups)]EntityType
+	// done is called with the parsed nodes once the whole window has been parsed.
+	done func(nodes []Node)
+
+	// text holds the escaped text since the last entity, and plain the unescaped text not yet added to nodes.
+	text  strings.Builder
+	plain strings.Builder
+	nodes []Node
+}
+
+// endText unescapes the text written since the last entity.
+func (f *parseFrame) endText() {
+	if f.text.Len() > 0 {
+		f.plain.WriteString(html.UnescapeString(f.text.String()))
+		f.text.Reset()
 	}
+}
 
-	if !validStart(i, in) && !skipStarts[c] {
-		if c == '\\' && i+1 < len(in) {
-			escaped := string(in[i+1])
-			if _, ok := chars[escaped]; ok {
-				return escaped, 1, false
-			}
+// appendNodes adds nodes after the current text. Adjacent text nodes are merged.
+func (f *parseFrame) appendNodes(ns []Node) {
+	f.endText()
+	for _, n := range ns {
+		if t, ok := n.(*Text); ok {
+			f.plain.WriteString(t.Value)
+			continue
 		}
-		return "", 0, false
+		f.flushText()
+		f.nodes = append(f.nodes, n)
 	}
+}
 
-	item := string(c)
-	if c == '|' &&
-		i+1 < len(in) && in[i+1] == '|' {
-		return "||", 1, true
-
-	} else if c == '_' &&
-		i+1 < len(in) && in[i+1] == '_' { // support __
-		return "__", 1, true
-
-	} else if c == '`' &&
-		i+2 < len(in) && in[i+1] == '`' && in[i+2] == '`' { // support ```
-		return "```", 2, true
-
-	} else if c == '&' &&
-		i+3 < len(in) && in[i+1] == 'g' && in[i+2] == 't' && in[i+3] == ';' &&
-		validBlockQuoteStart(in, i) {
-		return "&gt;", 3, true
+// flushText adds the unescaped text as a node.
+func (f *parseFrame) flushText() {
+	if f.plain.Len() > 0 {
+		f.nodes = append(f.nodes, &Text{Value: f.plain.String()})
+		f.plain.Reset()
+	}
+}
 
-	} else if c == '*' &&
-		i+5 < len(in) && in[i+1] == '*' && in[i+2] == '&' && in[i+3] == 'g' && in[i+4] == 't' && in[i+5] == ';' &&
-		// We force support for **> to allow for people to separate quotes/expandable quote blocks with **
-		validBlockQuoteStart(in, i) {
-		return "**&gt;", 5, true
+// follow continues parsing from the end of an entity.
+func (f *parseFrame) follow(end int) {
+	f.lo, f.i = end, end
+}
 
-	} else if c == '!' && i+1 < len(in) && in[i+1] == '[' {
-		return "![", 1, true
+// nested stops parsing f at an entity of type t, whose contents are b.runes[lo:hi]. The returned frame parses the
+// contents, and passes them to done; then f continues from end. t is empty if the contents aren't inside a new entity.
+func (f *parseFrame) nested(t EntityType, b *parseBuffer, lo int, hi int, end int, done func(nodes []Node)) *parseFrame {
+	f.endText()
+	f.follow(end)
+	child := &parseFrame{buf: b, lo: lo, hi: hi, i: lo, entity: t, done: done, blockedBy: f.blockedBy}
+	if t == "" {
+		return child
 	}
+	for idx, group := range nestingGroups {
+		if !canContain(t, group) {
+			child.blockedBy[idx] = t
+		}
+	}
+	return child
+}
 
-	return item, 0, true
+// md2html parses the escaped input into nodes. Entities which telegram doesn't allow to be nested inside their parents
+// are flattened; see canContain.
+func (p *parserV2) md2html(b *parseBuffer) []Node {
+	var out []Node
+	p.stack = []*parseFrame{{buf: b, hi: len(b.runes), done: func(nodes []Node) { out = nodes }}}
+	for len(p.stack) > 0 {
+		f := p.stack[len(p.stack)-1]
+		child := p.parseFrame(f)
+		if p.err != nil {
+			return nil
+		}
+		if child != nil {
+			if !p.checkLimit(LimitDepth, len(p.stack), p.cv.Limits.MaxDepth) || (child.entity != "" && !p.newEntity()) {
+				return nil
+			}
+			p.stack = append(p.stack, child)
+			continue
+		}
+		p.stack = p.stack[:len(p.stack)-1]
+		f.endText()
+		f.flushText()
+		f.done(f.nodes)
+	}
+	return out
 }
 
-// TODO: add support for a map-like check of which items cannot be included.
-//
-//	Eg: `code` cannot be italic/bold/underline/strikethrough
-//	however... this is currently implemented by server side by telegram, so not my problem :runs:
-//
-// (see notes on: https://core.telegram.org/bots/api#markdownv2-style)
-func (cv ConverterV2) md2html(in []rune, enableButtons bool) (string, []ButtonV2) {
-	out := strings.Builder{}
+// parseFrame parses the frame's window until it reaches the end, or an entity whose contents need parsing. In the
+// latter case, a frame for the entity's contents is returned.
+func (p *parserV2) parseFrame(f *parseFrame) *parseFrame {
+	b := f.buf
+	for f.i < f.hi && p.step() {
+		if d, end, ok := p.getDirective(b, f.lo, f.i, f.hi); ok {
+			if !p.newEntity() {
+				return nil
+			}
+			f.appendNodes([]Node{&DirectiveNode{Directive: d}})
+			f.follow(end)
+			continue
+		}
 
-	for i := 0; i < len(in); i++ {
-		item, offset, ok := getItem(in, i)
+		in := b.runes[f.lo:f.hi]
+		start := f.i
+		item, offset, ok := p.delims.getItem(in, f.i-f.lo)
 		if !ok {
 			if item == "" {
-				item = string(in[i])
+				item = string(b.runes[f.i])
 			}
-			out.WriteString(item)
-			i += offset
+			f.text.WriteString(item)
+			f.i += offset + 1
 			continue
 		}
-		i += offset
+		i := f.i + offset
+		f.i = i + 1
 
-		switch item {
+		switch t, isDelim := p.delims.entities[item]; {
 		// All cases where start and closing tags are the same.
-		case "`", "*", "~", "_", "```", "||", "__":
-			idx := getValidEnd(in[i+1:], item)
-			if idx < 0 {
+		case isDelim:
+			nEnd := b.getValidEnd(i+1, f.hi, item)
+			if nEnd < 0 {
 				// not found; write and move on.
-				out.WriteString(item)
+				p.addDiagnostic(b.pos[start], DiagnosticUnclosedDelimiter, "unclosed %q", item)
+				f.text.WriteString(item)
 				continue
 			}
+			nStart := i + 1
+			end := nEnd + len(item)
+			if p.keepAsText(b.pos[start], t) {
+				if t == EntityCode || t == EntityPre {
+					// The contents of code aren't markdown, so they are kept as they are.
+					p.addCodeRange(b, start, end)
+					f.text.WriteString(string(b.runes[start:end]))
+					f.i = end
+					continue
+				}
+				// The contents are parsed as they would be inside the entity, between the delimiters written as text.
+				f.text.WriteString(item)
+				return f.nested("", b, nStart, nEnd, end, func(nested []Node) {
+					f.appendNodes(nested)
+					f.text.WriteString(item)
+				})
+			}
 
-			nStart, nEnd := i+1, i+idx+1
-			followT, followB := cv.md2html(in[nEnd+len(item):], enableButtons)
-
-			switch item {
-			case "`":
+			switch t {
+			case EntityCode:
 				// ` doesn't support nested items, so don't parse children.
-				return out.String() + "<code>" + string(in[nStart:nEnd]) + "</code>" + followT, followB
+				if !p.newEntity() {
+					return nil
+				}
+				c := &Code{Value: html.UnescapeString(string(b.runes[nStart:nEnd]))}
+				if c.Value == "" {
+					p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty code")
+				}
+				p.addCodeRange(b, start, end)
+				f.appendNodes(p.nest(b.pos[start], c))
+				f.follow(end)
+				continue
 
-			case "```":
+			case EntityPre:
 				// ``` doesn't support nested items, so don't parse children.
-				nestedT := string(in[nStart:nEnd])
-
-				// Attempt to extract language details; should only be first line
-				splitLines := strings.Split(nestedT, "\n")
-				if len(splitLines) > 1 {
-					// TODO: How do we decide the language; first word? first line?
-					firstLine := strings.TrimSpace(splitLines[0])
-					if len(firstLine) > 0 && strings.HasPrefix(nestedT, firstLine) {
-						content := strings.TrimPrefix(nestedT, firstLine+"\n")
-						return out.String() + "<pre><code class=\"language-" + firstLine + "\">" + content + "</code></pre>" + followT, followB
-					}
+				if !p.newEntity() {
+					return nil
+				}
+				pre := newPre(string(b.runes[nStart:nEnd]))
+				if pre.Value == "" {
+					p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty code block")
 				}
-				return out.String() + "<pre>" + strings.TrimPrefix(nestedT, "\n") + "</pre>" + followT, followB
+				p.addCodeRange(b, start, end)
+				f.appendNodes(p.nest(b.pos[start], pre))
+				f.follow(end)
+				continue
 			}
 
 			// internal won't have any interesting item closings
-			nestedT, nestedB := cv.md2html(in[nStart:nEnd], enableButtons)
-			return out.String() + "<" + chars[item] + ">" + nestedT + "</" + closeSpans(chars[item]) + ">" + followT, append(nestedB, followB...)
+			return f.nested(t, b, nStart, nEnd, end, func(nested []Node) {
+				f.appendNodes(p.nest(b.pos[start], newFormatting(t, nested)))
+			})
+
+		case item == "&gt;" || item == "**&gt;":
+			t := EntityBlockquote
+			if item == "**&gt;" {
+				t = EntityExpandableBlockquote
+			}
+			if p.keepAsText(b.pos[start], t) {
+				f.text.WriteString(item)
+				continue
+			}
 
-		case "&gt;", "**&gt;":
 			nStart := i + 1
-			for nStart < len(in) && unicode.IsSpace(in[nStart]) {
+			for nStart < f.hi && unicode.IsSpace(b.runes[nStart]) {
 				nStart++
 			}
 
-			if nStart >= len(in) {
-				out.WriteString(item)
+			if nStart >= f.hi {
+				f.text.WriteString(item)
 				continue
 			}
 
-			nEnd, contents, expandable := getBlockQuoteEnd(in, nStart)
-			nestedT, nestedB := cv.md2html(contents, enableButtons)
-			followT, followB := cv.md2html(in[nEnd:], enableButtons)
-
-			if expandable {
-				return out.String() + "<blockquote expandable>" + strings.TrimSpace(nestedT) + "</blockquote>" + followT, append(nestedB, followB...)
+			end, contents, cLo, cHi, expandable := b.getBlockQuote(f.lo, f.hi, nStart)
+			return f.nested(EntityBlockquote, contents, cLo, cHi, end, func(nested []Node) {
+				nested = trimNodes(nested)
+				if len(nested) == 0 {
+					p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty blockquote")
+				}
+				f.appendNodes(p.nest(b.pos[start], &Blockquote{Expandable: expandable, Children: nested}))
+			})
+
+		case item == "![":
+			textEnd, linkEnd := b.findLinkSectionsIdx(i, f.hi, true)
+			if textEnd < 0 {
+				if b.findLinkMidSectionIdx(i, f.hi, true) >= 0 {
+					p.addDiagnostic(b.pos[start], DiagnosticUnclosedDelimiter, "unclosed %q", item)
+				}
+				f.text.WriteString(item)
+				continue
 			}
-			return out.String() + "<blockquote>" + strings.TrimSpace(nestedT) + "</blockquote>" + followT, append(nestedB, followB...)
 
-		case "![":
-			ok, text, content, newEnd := getLinkContents(in[i:], true)
+			failure, ok := b.failedLinks[textEnd]
+			var n Node
 			if !ok {
-				out.WriteString(item)
+				n, failure = p.parseSpecialLink(b.pos[start], string(b.runes[textEnd+2:linkEnd]))
+			}
+			if failure != nil {
+				// The same link may be found again from a later "![", so remember why it failed.
+				if b.failedLinks == nil {
+					b.failedLinks = map[int]*linkFailure{}
+				}
+				b.failedLinks[textEnd] = failure
+				if failure.kind != "" {
+					p.addDiagnostic(b.pos[start], failure.kind, "%s", failure.message)
+				}
+				f.text.WriteString(item)
 				continue
 			}
-			end := i + newEnd
 
-			contentType, content, ok := strings.Cut(strings.TrimPrefix(content, "tg://"), "?")
-			if !ok {
-				out.WriteString(item)
+			t := nodeEntityType(n)
+			if p.keepAsText(b.pos[start], t) {
+				f.text.WriteString(item)
 				continue
 			}
-
-			queryForm, err := url.ParseQuery(html.UnescapeString(content))
-			if err != nil {
-				out.WriteString(item)
+			if textEnd == i+1 {
+				name := string(t)
+				switch t {
+				case EntityCustomEmoji:
+					name = "emoji"
+				case EntityDateTime:
+					name = "time"
+				}
+				p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty %s text", name)
+			}
+			return f.nested(t, b, i+1, textEnd, linkEnd+1, func(nested []Node) {
+				switch n := n.(type) {
+				case *CustomEmoji:
+					n.Children = nested
+				case *Time:
+					n.Children = nested
+				case *SpecialLink:
+					n.Children = nested
+				}
+				f.appendNodes(p.nest(b.pos[start], n))
+			})
+
+		case item == "[":
+			textEnd, linkEnd := b.findLinkSectionsIdx(i, f.hi, false)
+			if textEnd < 0 {
+				if b.findLinkMidSectionIdx(i, f.hi, false) >= 0 {
+					p.addDiagnostic(b.pos[start], DiagnosticUnclosedDelimiter, "unclosed link")
+				}
+				f.text.WriteString(item)
 				continue
 			}
-
-			nestedT, nestedB := cv.md2html(text, enableButtons)
-			followT, followB := cv.md2html(in[end:], enableButtons)
-
-			switch contentType {
-			case "emoji":
-				// id=5368324170671202286
-				id := queryForm.Get("id")
-				if id == "" {
-					out.WriteString(item)
+			text := b.runes[i+1 : textEnd]
+			content := string(b.runes[textEnd+2 : linkEnd])
+
+			if p.enableButtons {
+				var n Node
+				if btn, ok := p.cv.getButton(p.cv.Prefixes, text, content); ok {
+					if btn.Type == ButtonTypeURL {
+						link, err := p.cv.CheckURL(html.UnescapeString(btn.Content))
+						if err != nil {
+							p.addDiagnostic(b.pos[start], DiagnosticRejectedLink, "%s", err)
+							f.text.WriteString(item)
+							continue
+						}
+						btn.Content = html.EscapeString(link)
+					}
+					p.addButtonDiagnostics(b.pos[start], btn)
+					n = &ButtonNode{ButtonV2: btn}
+				} else if btn, ok := p.cv.getButton(p.cv.ReplyPrefixes, text, content); ok {
+					p.addButtonDiagnostics(b.pos[start], btn)
+					n = &ReplyButtonNode{ButtonV2: btn}
+				} else if opts, ok := p.cv.getReplyKeyboardOptions(text, content); ok {
+					if opts.Err != nil {
+						p.addDiagnostic(b.pos[start], DiagnosticInvalidButton, "%s", opts.Err)
+					}
+					n = &ReplyKeyboardNode{ReplyKeyboardOptions: opts}
+				}
+				if n != nil {
+					if !p.newEntity() {
+						return nil
+					}
+					f.appendNodes([]Node{n})
+					f.follow(linkEnd + 1)
 					continue
 				}
+			}
 
-				return out.String() + `<tg-emoji emoji-id="` + id + `">` + nestedT + "</tg-emoji>" + followT, append(nestedB, followB...)
-			case "time":
-				// unix="1647531900" format="wDT"
-				unix := queryForm.Get("unix")
-				if unix == "" {
-					out.WriteString(item)
+			link := html.UnescapeString(content)
+			t := EntityTextLink
+			_, isMention, mentionErr := getMentionID(link)
+			if isMention && mentionErr == nil {
+				t = EntityTextMention
+			}
+			if p.keepAsText(b.pos[start], t) {
+				f.text.WriteString(item)
+				continue
+			}
+			if t == EntityTextLink {
+				checked, err := p.cv.CheckURL(link)
+				if err != nil {
+					p.addDiagnostic(b.pos[start], DiagnosticRejectedLink, "%s", err)
+					f.text.WriteString(item)
 					continue
 				}
-				format := queryForm.Get("format")
-				if format != "" {
-					return out.String() + `<tg-time unix="` + unix + `" format="` + format + `">` + nestedT + "</tg-time>" + followT, append(nestedB, followB...)
-				}
-				return out.String() + `<tg-time unix="` + unix + `">` + nestedT + "</tg-time>" + followT, append(nestedB, followB...)
-
-			default:
-				out.WriteString(item)
+				link = checked
 			}
 
-		case "[":
-			ok, text, content, newEnd := getLinkContents(in[i:], false)
-			if !ok {
-				out.WriteString(item)
-				continue
+			if len(text) == 0 {
+				p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty link text")
 			}
-			end := i + newEnd
+			if content == "" {
+				p.addDiagnostic(b.pos[start], DiagnosticEmptyEntity, "empty link URL")
+			}
+			if isMention && mentionErr != nil {
+				p.addDiagnostic(b.pos[start], DiagnosticBadUserID, "invalid mention: %s", mentionErr)
+			}
+			return f.nested(t, b, i+1, textEnd, linkEnd+1, func(nested []Node) {
+				f.appendNodes(p.nest(b.pos[start], newLink(link, nested)))
+			})
+
+		case item == "\\":
+			if i+1 < f.hi {
+				if p.delims.escapable[b.runes[i+1]] {
+					f.text.WriteRune(b.runes[i+1])
+					f.i++
+					continue
+				}
+			}
+			f.text.WriteString(item)
 
-			followT, followB := cv.md2html(in[end:], enableButtons)
+		default:
+			f.text.WriteString(item)
+		}
+	}
+	return nil
+}
 
-			if enableButtons {
-				for buttonType, prefix := range cv.Prefixes {
-					pref, url, ok := strings.Cut(content, ":")
-					if !ok {
-						continue
-					}
+// nest checks that the node is allowed by the converter, and can be nested inside all of its parents. If it can't, a
+// diagnostic is added, and the node's contents are returned without the node itself, so that telegram still accepts
+// the message.
+func (p *parserV2) nest(offset int, n Node) []Node {
+	t := nodeEntityType(n)
+	if !p.cv.allowsEntity(t) {
+		p.addDiagnostic(offset, DiagnosticDisallowedEntity, "%s is not allowed", t)
+		return flattenNode(n)
+	}
+	if parent := p.stack[len(p.stack)-1].blockedBy[nestingGroup(t)]; parent != "" {
+		p.addDiagnostic(offset, DiagnosticInvalidNesting, "%s cannot be nested inside %s", t, parent)
+		return flattenNode(n)
+	}
+	return []Node{n}
+}
 
-					var style string
-					if p, s, ok := strings.Cut(pref, "#"); ok {
-						style = s
-						pref = p
-					}
+// canContain reports whether telegram allows a child entity to be nested inside the parent entity.
+//   - bold, italic, underline, strikethrough and spoiler can contain anything except code and pre.
+//   - blockquotes can contain anything except other blockquotes.
+//   - code and pre can't contain anything.
+//   - links, custom emoji, times and the entities of LinkHandlers can only contain bold, italic, underline,
+//     strikethrough and spoiler.
+//
+// (see notes on: https://core.telegram.org/bots/api#formatting-options)
+func canContain(parent EntityType, child EntityType) bool {
+	switch parent {
+	case EntityBold, EntityItalic, EntityUnderline, EntityStrikethrough, EntitySpoiler:
+		return child != EntityCode && child != EntityPre
+	case EntityBlockquote, EntityExpandableBlockquote:
+		return child != EntityBlockquote && child != EntityExpandableBlockquote
+	case EntityCode, EntityPre:
+		return false
+	}
+	switch child {
+	case EntityBold, EntityItalic, EntityUnderline, EntityStrikethrough, EntitySpoiler:
+		return true
+	}
+	return false
+}
 
-					if pref != prefix {
-						continue
-					}
+// nestingGroups are the groups of entities which canContain treats the same way, whatever their parent.
+var nestingGroups = [...]EntityType{EntityBold, EntityCode, EntityBlockquote, EntityTextLink}
+
+// nestingGroup returns the index of the entity's group in nestingGroups.
+func nestingGroup(t EntityType) int {
+	switch t {
+	case EntityBold, EntityItalic, EntityUnderline, EntityStrikethrough, EntitySpoiler:
+		return 0
+	case EntityCode, EntityPre:
+		return 1
+	case EntityBlockquote, EntityExpandableBlockquote:
+		return 2
+	}
+	return 3
+}
 
-					content := strings.TrimLeft(url, "/")
-					sameline := strings.HasSuffix(content, cv.SameLineSuffix)
-					if sameline {
-						content = strings.TrimSuffix(content, cv.SameLineSuffix)
-					}
-					cleanedName := cv.StripMDV2(string(text))
-					return out.String() + followT, append([]ButtonV2{{
-						Name:     html.UnescapeString(cleanedName),
-						Type:     buttonType,
-						Content:  content,
-						SameLine: sameline,
-						Style:    style,
-					}}, followB...)
-				}
-			}
+func nodeEntityType(n Node) EntityType {
+	switch n := n.(type) {
+	case *Bold:
+		return EntityBold
+	case *Italic:
+		return EntityItalic
+	case *Underline:
+		return EntityUnderline
+	case *Strike:
+		return EntityStrikethrough
+	case *Spoiler:
+		return EntitySpoiler
+	case *Code:
+		return EntityCode
+	case *Pre:
+		return EntityPre
+	case *Link:
+		return EntityTextLink
+	case *Mention:
+		return EntityTextMention
+	case *CustomEmoji:
+		return EntityCustomEmoji
+	case *Time:
+		return EntityDateTime
+	case *SpecialLink:
+		return n.Handler.Entity(n.Data).Type
+	case *Blockquote:
+		if n.Expandable {
+			return EntityExpandableBlockquote
+		}
+		return EntityBlockquote
+	}
+	return ""
+}
 
-			nestedT, nestedB := cv.md2html(text, enableButtons)
-			return out.String() + `<a href="` + content + `">` + nestedT + "</a>" + followT, append(nestedB, followB...)
+// flattenNode removes the formatting of a node, keeping its contents.
+func flattenNode(n Node) []Node {
+	switch n := n.(type) {
+	case *Code:
+		return []Node{&Text{Value: n.Value}}
+	case *Pre:
+		return []Node{&Text{Value: n.Value}}
+	}
+	return children(n)
+}
 
-		case "\\":
-			if i+1 < len(in) {
-				if _, ok := chars[string(in[i+1])]; ok {
-					out.WriteRune(in[i+1])
-					i++
-					continue
-				}
+func newFormatting(t EntityType, nested []Node) Node {
+	switch t {
+	case EntityBold:
+		return &Bold{Children: nested}
+	case EntityItalic:
+		return &Italic{Children: nested}
+	case EntityUnderline:
+		return &Underline{Children: nested}
+	case EntityStrikethrough:
+		return &Strike{Children: nested}
+	default: // EntitySpoiler
+		return &Spoiler{Children: nested}
+	}
+}
+
+func newPre(nestedT string) *Pre {
+	// Attempt to extract language details; should only be first line
+	splitLines := strings.Split(nestedT, "\n")
+	if len(splitLines) > 1 {
+		// TODO: How do we decide the language; first word? first line?
+		firstLine := strings.TrimSpace(splitLines[0])
+		if len(firstLine) > 0 && strings.HasPrefix(nestedT, firstLine) {
+			return &Pre{
+				Language: html.UnescapeString(firstLine),
+				Value:    html.UnescapeString(strings.TrimPrefix(nestedT, firstLine+"\n")),
 			}
-			out.WriteString(item)
+		}
+	}
+	return &Pre{Value: html.UnescapeString(strings.TrimPrefix(nestedT, "\n"))}
+}
 
-		default:
-			out.WriteString(item)
+// getButton checks whether a link's content uses one of the given button prefixes, and returns the button if so.
+func (cv ConverterV2) getButton(prefixes map[string]string, text []rune, content string) (ButtonV2, bool) {
+	for buttonType, prefix := range prefixes {
+		pref, url, ok := strings.Cut(content, ":")
+		if !ok {
+			continue
 		}
+
+		var icon string
+		if p, i, ok := strings.Cut(pref, "@"); ok {
+			icon = i
+			pref = p
+		}
+
+		var style string
+		if p, s, ok := strings.Cut(pref, "#"); ok {
+			style = s
+			pref = p
+		}
+
+		if pref != prefix {
+			continue
+		}
+
+		content := strings.TrimLeft(url, "/")
+		sameline := strings.HasSuffix(content, cv.SameLineSuffix)
+		if sameline {
+			content = strings.TrimSuffix(content, cv.SameLineSuffix)
+		}
+		cleanedName := cv.StripMDV2(string(text))
+		btn := ButtonV2{
+			Name:     html.UnescapeString(cleanedName),
+			Type:     buttonType,
+			Content:  content,
+			SameLine: sameline,
+			Style:    style,
+			Icon:     icon,
+		}
+		btn.Err = btn.Validate()
+		return btn, true
+	}
+	return ButtonV2{}, false
+}
+
+// getBlockQuote returns the end of a blockquote starting at nStart, in a window of the buffer from lo to hi, and whether
+// it is expandable. Its contents are returned as a window of a buffer; for quotes over several lines, the '>' starting
+// each line is removed, so a new buffer is made.
+func (b *parseBuffer) getBlockQuote(lo int, hi int, nStart int) (int, *parseBuffer, int, int, bool) {
+	in := b.runes[lo:hi]
+	j := min(b.lineEnd(nStart), hi)
+	switch {
+	case j == hi && isExpandableEnd(in, hi-lo):
+		return hi, b, nStart, hi - 2, true
+	case j == hi:
+		return hi, b, nStart, hi, false
+	case isExpandableEnd(in, j-lo):
+		return j, b, nStart, j - 2, true
+	case !(j+4 < hi && b.runes[j+1] == '&' && b.runes[j+2] == 'g' && b.runes[j+3] == 't' && b.runes[j+4] == ';'):
+		// The newline is kept in the contents, and trimmed later.
+		return j, b, nStart, j + 1, false
 	}
 
-	return out.String(), nil
+	end, contents, contentsPos, expandable := getBlockQuoteEnd(in, b.pos[lo:hi], nStart-lo)
+	b.addWork(end - (nStart - lo))
+	return lo + end, newParseBuffer(contents, contentsPos, b.linkPrefixes, b.work), 0, len(contents), expandable
 }
 
-func getBlockQuoteEnd(in []rune, nStart int) (int, []rune, bool) {
+// getBlockQuoteEnd returns the end of the blockquote, its contents, the input position of each rune in the contents,
+// and whether it is expandable.
+func getBlockQuoteEnd(in []rune, pos []int, nStart int) (int, []rune, []int, bool) {
 	var contents []rune // We store all the contents, minus the > characters, so we avoid double-html tags
+	var contentsPos []int
 	lineStart := true
 	for j := nStart; j < len(in); j++ {
 		if lineStart && in[j] == ' ' {
@@ -373,6 +789,7 @@ func getBlockQuoteEnd(in []rune, nStart int) (int, []rune, bool) {
 
 		lineStart = in[j] == '\n'
 		contents = append(contents, in[j])
+		contentsPos = append(contentsPos, pos[j])
 
 		// Keep skipping until we get a newline
 		if in[j] != '\n' {
@@ -381,21 +798,21 @@ func getBlockQuoteEnd(in []rune, nStart int) (int, []rune, bool) {
 
 		if isExpandableEnd(in, j) {
 			// Extra -1 to include newline
-			return j, contents[:len(contents)-3], true
+			return j, contents[:len(contents)-3], contentsPos[:len(contents)-3], true
 		}
 
 		if j+4 < len(in) && in[j+1] == '&' && in[j+2] == 'g' && in[j+3] == 't' && in[j+4] == ';' {
 			j = j + 4 // skip '>' symbol for the next blockquote start
 			continue
 		}
-		return j, contents, false
+		return j, contents, contentsPos, false
 	}
 
 	if isExpandableEnd(in, len(in)) {
-		return len(in), contents[:len(contents)-2], true
+		return len(in), contents[:len(contents)-2], contentsPos[:len(contents)-2], true
 	}
 
-	return len(in), contents, false
+	return len(in), contents, contentsPos, false
 }
 
 func isExpandableEnd(in []rune, j int) bool {
@@ -417,9 +834,13 @@ func validBlockQuoteStart(in []rune, i int) bool {
 }
 
 func EscapeMarkdownV2(r []rune) string {
+	return defaultConverterV2.EscapeMarkdown(r)
+}
+
+func escapeMarkdown(r []rune, chars []rune) string {
 	out := strings.Builder{}
 	for i, x := range r {
-		if slices.Contains(AllMarkdownV2Chars, x) {
+		if slices.Contains(chars, x) {
 			if i == 0 || i == len(r)-1 || validEnd(i, r) || validStart(i, r) {
 				out.WriteRune('\\')
 			}
@@ -428,15 +849,3 @@ func EscapeMarkdownV2(r []rune) string {
 	}
 	return out.String()
 }
-
-// closeSpans gets the correct closing tags for spans.
-// eg:
-// - closeSpans("span class=\"tg-spoiler\"") should return just "span"
-// - closeSpans("pre") -> returns "pre"
-func closeSpans(s string) string {
-	if !strings.HasPrefix(s, "span") {
-		return s
-	}
-
-	return "span"
-}
@@ -1,6 +1,7 @@
 package tg_md2html_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -176,6 +177,39 @@ func TestNotMD2HTMLV2(t *testing.T) {
 	}
 }
 
+func TestMD2HTMLV2Nesting(t *testing.T) {
+	// Entities which telegram doesn't allow to be nested are flattened, so the message can still be sent.
+	for _, x := range []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "*bold `code`*",
+			out: "<b>bold code</b>",
+		}, {
+			in:  "||```go\nfmt.Println()```||",
+			out: `<span class="tg-spoiler">fmt.Println()</span>`,
+		}, {
+			in:  "[![👍](tg://emoji?id=5368324170671202286) link](example.com)",
+			out: `<a href="example.com">👍 link</a>`,
+		}, {
+			in:  ">>nested quote",
+			out: "<blockquote>nested quote</blockquote>",
+		}, {
+			// Formatting can be nested anywhere.
+			in:  "*[_link_](example.com)* ||spoiler ~strike~||",
+			out: `<b><a href="example.com"><i>link</i></a></b> <span class="tg-spoiler">spoiler <s>strike</s></span>`,
+		}, {
+			in:  ">`code` ```pre```",
+			out: "<blockquote><code>code</code> <pre>pre</pre></blockquote>",
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			assert.Equal(t, x.out, tg_md2html.MD2HTMLV2(x.in))
+		})
+	}
+}
+
 var md2HTMLV2Buttons = []struct {
 	in   string
 	out  string
@@ -197,6 +231,30 @@ var md2HTMLV2Buttons = []struct {
 			Type:    "url",
 			Content: "test.com",
 		}},
+	}, {
+		in:  "[Rules](buttoncb:rules_page_1)",
+		out: "",
+		btns: []tg_md2html.ButtonV2{{
+			Name:    "Rules",
+			Type:    "callback",
+			Content: "rules_page_1",
+		}},
+	}, {
+		in:  "[Site](buttonurl#primary@5368324170671202286://example.com)\n[Help](buttoncb@5368324170671202287://help:same)",
+		out: "",
+		btns: []tg_md2html.ButtonV2{{
+			Name:    "Site",
+			Type:    "url",
+			Content: "example.com",
+			Style:   "primary",
+			Icon:    "5368324170671202286",
+		}, {
+			Name:     "Help",
+			Type:     "callback",
+			Content:  "help",
+			SameLine: true,
+			Icon:     "5368324170671202287",
+		}},
 	}, {
 		in:  "Some text, some *bold*, and a button\n[hello](buttontext://some text)",
 		out: "Some text, some <b>bold</b>, and a button",
@@ -336,8 +394,65 @@ func TestMD2HTMLV2Buttons(t *testing.T) {
 	}
 }
 
+func TestMD2HTMLV2Large(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "unclosed delimiters",
+			in:   strings.Repeat("*a _b [c](", 20000),
+			out:  strings.Repeat("*a _b [c](", 20000),
+		}, {
+			name: "nested blockquotes",
+			in:   strings.Repeat(">", 50000) + "*quote*",
+			out:  "<blockquote><b>quote</b></blockquote>",
+		}, {
+			name: "delimiter runs",
+			in:   strings.Repeat("*", 40001),
+			out:  strings.Repeat("<b>", 20000) + "*" + strings.Repeat("</b>", 20000),
+		}, {
+			name: "multi-character delimiter runs",
+			in:   strings.Repeat("||", 20001),
+			out:  strings.Repeat(`<span class="tg-spoiler">`, 10000) + "||" + strings.Repeat("</span>", 10000),
+		}, {
+			name: "many entities",
+			in:   strings.Repeat("*bold* _italic_ `code` [link](example.com) ", 20000),
+			out:  strings.TrimSpace(strings.Repeat(`<b>bold</b> <i>italic</i> <code>code</code> <a href="example.com">link</a> `, 20000)),
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.out, tg_md2html.MD2HTMLV2(x.in))
+		})
+	}
+}
+
+func TestConvertV2(t *testing.T) {
+	res := testConverter().Convert("Welcome [Alice](tg://user?id=1234) and *[Bob](tg://user?id=5678)*! [Alice](tg://user?id=1234) " +
+		"[not a user](tg://user?id=abc)\n[Rules](buttonurl://example.com)")
+	assert.Equal(t, `Welcome <a href="tg://user?id=1234">Alice</a> and <b><a href="tg://user?id=5678">Bob</a></b>! `+
+		`<a href="tg://user?id=1234">Alice</a> <a href="tg://user?id=abc">not a user</a>`, res.HTML)
+	assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Rules", Type: "url", Content: "example.com"}}, res.Buttons)
+	assert.Equal(t, []int64{1234, 5678}, res.Mentions)
+}
+
 func BenchmarkMD2HTMLV2(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		v, bs2 = tg_md2html.MD2HTMLButtonsV2(message)
 	}
 }
+
+func BenchmarkMD2HTMLV2DelimiterRuns(b *testing.B) {
+	in := strings.Repeat("*", 40000)
+	for i := 0; i < b.N; i++ {
+		v, bs2 = tg_md2html.MD2HTMLButtonsV2(in)
+	}
+}
+
+func BenchmarkMD2HTMLV2Unclosed(b *testing.B) {
+	in := strings.Repeat("*a _b [c](", 10000)
+	for i := 0; i < b.N; i++ {
+		v, bs2 = tg_md2html.MD2HTMLButtonsV2(in)
+	}
+}
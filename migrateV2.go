@@ -0,0 +1,108 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MigrationIssue describes something which could not be preserved when migrating V1 markdown to V2.
+type MigrationIssue struct {
+	// Message describes what changed.
+	Message string
+}
+
+func (i MigrationIssue) String() string {
+	return i.Message
+}
+
+// MigrateV1ToV2 rewrites markdown written for the V1 Converter into ConverterV2 markdown, such that
+// v2.MD2HTMLButtons(out) returns the same HTML and buttons as v1.MD2HTMLButtons(in).
+// Characters which are literal in V1 but have a meaning in V2 (eg ~, |, >, __ and !) are escaped.
+// If either converter is nil, the default one is used.
+//
+// The output is checked by parsing it again; anything which could not be preserved is returned as a MigrationIssue.
+// An error is only returned if the input cannot be migrated at all.
+func MigrateV1ToV2(in string, v1 *Converter, v2 *ConverterV2) (string, []MigrationIssue, error) {
+	if v1 == nil {
+		v1 = &defaultConverter
+	}
+	if v2 == nil {
+		v2 = &defaultConverterV2
+	}
+
+	htmlV1, btnsV1 := v1.MD2HTMLButtons(in)
+	doc, err := v2.ParseHTML(htmlV1)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse V1 HTML: %w", err)
+	}
+
+	btnType, err := v2.migrationButtonType(v1)
+	if err != nil && len(btnsV1) > 0 {
+		return "", nil, err
+	}
+
+	btns := make([]ButtonV2, 0, len(btnsV1))
+	for _, b := range btnsV1 {
+		btns = append(btns, ButtonV2{
+			Name:     b.Name,
+			Type:     btnType,
+			Content:  b.Content,
+			SameLine: b.SameLine,
+		})
+	}
+
+	out, err := v2.reverseDocument(doc, btns, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to write V2 markdown: %w", err)
+	}
+
+	// Check that nothing was lost.
+	var issues []MigrationIssue
+	htmlV2, btnsV2 := v2.MD2HTMLButtons(out)
+	if htmlV2 != htmlV1 {
+		issues = append(issues, MigrationIssue{
+			Message: fmt.Sprintf("formatting could not be preserved: expected %q, got %q", htmlV1, htmlV2),
+		})
+	}
+	for idx := range max(len(btns), len(btnsV2)) {
+		switch {
+		case idx >= len(btnsV2):
+			issues = append(issues, MigrationIssue{Message: fmt.Sprintf("button %d (%s) was lost", idx, btns[idx].Name)})
+		case idx >= len(btns):
+			issues = append(issues, MigrationIssue{Message: fmt.Sprintf("unexpected new button %d (%s)", idx, btnsV2[idx].Name)})
+		case !sameButton(btns[idx], btnsV2[idx]):
+			issues = append(issues, MigrationIssue{
+				Message: fmt.Sprintf("button %d could not be preserved: expected %+v, got %+v", idx, btns[idx], btnsV2[idx]),
+			})
+		}
+	}
+
+	return out, issues, nil
+}
+
+// sameButton reports whether the buttons are the same. Errors are compared by message, since each parse creates new
+// error values.
+func sameButton(a ButtonV2, b ButtonV2) bool {
+	errMessage := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	return a.Name == b.Name && a.Type == b.Type && a.Content == b.Content && a.SameLine == b.SameLine &&
+		a.Style == b.Style && a.Icon == b.Icon && (a.Err == nil) == (b.Err == nil) && errMessage(a.Err) == errMessage(b.Err)
+}
+
+// migrationButtonType finds the V2 button type to use for V1 buttons; either the type using the same prefix, or "url".
+func (cv ConverterV2) migrationButtonType(v1 *Converter) (string, error) {
+	v1Prefix := strings.TrimSuffix(v1.BtnPrefix, ":")
+	for btnType, prefix := range cv.Prefixes {
+		if prefix == v1Prefix {
+			return btnType, nil
+		}
+	}
+	if _, ok := cv.Prefixes["url"]; ok {
+		return "url", nil
+	}
+	return "", fmt.Errorf("no V2 button type for V1 button prefix %q", v1.BtnPrefix)
+}
@@ -0,0 +1,76 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestMigrateV1ToV2(t *testing.T) {
+	for _, x := range []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "_hello_ *bold* `code` [link](example.com)",
+			out: "_hello_ *bold* `code` [link](example.com)",
+		}, {
+			in:  "~strike~ ||spoiler|| > quote __underline__ ![emoji](x)",
+			out: `\~strike\~ \|\|spoiler\|\| \> quote _\_underline_\_ \![emoji](x)`,
+		}, {
+			in:  "> quote",
+			out: `\> quote`,
+		}, {
+			in:  "*not_italic_inside*",
+			out: `*not\_italic\_inside*`,
+		}, {
+			in:  `escaped \_ and \*`,
+			out: `escaped \_ and \*`,
+		}, {
+			in:  "text\n[button](buttonurl://example.com)\n[same](buttonurl:example.com:same)",
+			out: "text\n[button](buttonurl://example.com)\n[same](buttonurl://example.com:same)",
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			out, issues, err := tg_md2html.MigrateV1ToV2(x.in, nil, nil)
+			assert.NoError(t, err)
+			assert.Empty(t, issues)
+			assert.Equal(t, x.out, out)
+
+			htmlV1, btnsV1 := tg_md2html.MD2HTMLButtons(x.in)
+			htmlV2, btnsV2 := tg_md2html.MD2HTMLButtonsV2(out)
+			assert.Equal(t, htmlV1, htmlV2)
+			assert.Equal(t, len(btnsV1), len(btnsV2))
+		})
+	}
+}
+
+func TestMigrateV1ToV2Converters(t *testing.T) {
+	v1 := &tg_md2html.Converter{BtnPrefix: "btn:", SameLineSuffix: ":same"}
+	v2 := tg_md2html.NewV2(map[string]string{"url": "link", "text": "btn"}, nil)
+
+	out, issues, err := tg_md2html.MigrateV1ToV2("*text*\n[button](btn://example.com)", v1, v2)
+	assert.NoError(t, err)
+	assert.Empty(t, issues)
+	assert.Equal(t, "*text*\n[button](btn://example.com)", out)
+
+	_, _, err = tg_md2html.MigrateV1ToV2("[button](btn://example.com)", v1, tg_md2html.NewV2(map[string]string{"text": "other"}, nil))
+	assert.Error(t, err)
+}
+
+func TestMigrateV1ToV2Issues(t *testing.T) {
+	for _, in := range []string{
+		// V1 has no code blocks, so this is three code entities; two of which are empty.
+		"```go\ncode```",
+		// V2 doesn't support ')' in link URLs.
+		`[link](example.com/\)path)`,
+	} {
+		t.Run(in, func(t *testing.T) {
+			_, issues, err := tg_md2html.MigrateV1ToV2(in, nil, nil)
+			assert.NoError(t, err)
+			assert.Len(t, issues, 1)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// FindingKind is the kind of deceptive link a Finding describes.
+type FindingKind string
+
+const (
+	// FindingMismatchedHost is reported when a link's text looks like a URL or domain, but the link goes to a
+	// different host; eg [https://bank.com](https://evil.example).
+	FindingMismatchedHost FindingKind = "mismatched_host"
+	// FindingMixedScript is reported when a label of the link's host, or of the host named by its text, mixes letters
+	// from scripts with lookalike characters, such as Latin and Cyrillic.
+	FindingMixedScript FindingKind = "mixed_script"
+	// FindingHomoglyph is reported when a label of the link's host, or of the host named by its text, is only made of
+	// non-Latin characters which look like Latin ones; eg аррӏе.com, in Cyrillic.
+	FindingHomoglyph FindingKind = "homoglyph"
+	// FindingInvisibleChars is reported when a link's text contains zero-width or other invisible formatting characters.
+	FindingInvisibleChars FindingKind = "invisible_characters"
+)
+
+// Finding describes a link which may be used to deceive users.
+type Finding struct {
+	Kind FindingKind
+	// Text is the plain text of the link, or the button name, and URL is where it goes.
+	Text string
+	URL  string
+	// Button is set when the link is a url button.
+	Button bool
+	// Host is the host the finding is about, in its unicode form; for FindingMismatchedHost, this is the host named by
+	// the link's text.
+	Host string
+	// Message is a human-readable explanation of the finding.
+	Message string
+}
+
+func AnalyzeLinksV2(in string) ([]Finding, error) {
+	return defaultConverterV2.AnalyzeLinks(in)
+}
+
+// AnalyzeLinks parses the markdown, and returns the findings for its links and url buttons; see Document.Findings.
+func (cv ConverterV2) AnalyzeLinks(in string) ([]Finding, error) {
+	doc, err := cv.Parse(in)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Findings(), nil
+}
+
+// Findings checks the document's links for deceptive text and hosts, in the order they appear, followed by its url buttons.
+// Mentions, custom emoji and times aren't checked, since they don't open a URL.
+func (d *Document) Findings() []Finding {
+	var findings []Finding
+	walkNodes(d.Nodes, func(n Node) {
+		if l, ok := n.(*Link); ok {
+			findings = append(findings, analyzeLink(nodesText(l.Children), l.URL, false)...)
+		}
+	})
+	for _, btn := range d.Buttons() {
+		if btn.Type == ButtonTypeURL {
+			findings = append(findings, analyzeLink(btn.Name, html.UnescapeString(btn.Content), true)...)
+		}
+	}
+	return findings
+}
+
+// nodesText returns the plain text of the nodes, without any formatting.
+func nodesText(nodes []Node) string {
+	out := strings.Builder{}
+	walkNodes(nodes, func(n Node) {
+		switch n := n.(type) {
+		case *Text:
+			out.WriteString(n.Value)
+		case *Code:
+			out.WriteString(n.Value)
+		case *Pre:
+			out.WriteString(n.Value)
+		}
+	})
+	return out.String()
+}
+
+func analyzeLink(text string, link string, button bool) []Finding {
+	var findings []Finding
+	add := func(kind FindingKind, host string, format string, args ...any) {
+		findings = append(findings, Finding{
+			Kind:    kind,
+			Text:    text,
+			URL:     link,
+			Button:  button,
+			Host:    host,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	visible := strings.Map(func(r rune) rune {
+		if isInvisible(r) {
+			return -1
+		}
+		return r
+	}, text)
+	if visible != text {
+		add(FindingInvisibleChars, "", "link text %q contains invisible characters", visible)
+	}
+
+	host := linkHost(link)
+	textHost := textHost(strings.TrimSpace(visible))
+	if textHost != "" && !sameSite(textHost, host) {
+		if host == "" {
+			add(FindingMismatchedHost, textHost, "link text names %s, but the link has no host", textHost)
+		} else {
+			add(FindingMismatchedHost, textHost, "link text names %s, but the link goes to %s", textHost, host)
+		}
+	}
+
+	// The host named by the text is checked too, since a lookalike there deceives users just the same.
+	hosts := []string{host}
+	if textHost != host {
+		hosts = append(hosts, textHost)
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		for _, label := range strings.Split(h, ".") {
+			if scripts := usedLookalikeScripts(label); len(scripts) > 1 {
+				add(FindingMixedScript, h, "%q mixes %s letters", label, strings.Join(scripts, " and "))
+				break
+			}
+			if skeleton, ok := homoglyphSkeleton(label); ok {
+				add(FindingHomoglyph, h, "%q looks like %q", label, skeleton)
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// isInvisible reports whether r is a zero-width or other invisible formatting character, such as U+200B, or one of the
+// Hangul fillers, which are letters that render as blank space.
+func isInvisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || r == '\u115F' || r == '\u1160' || r == '\u3164' || r == '\uFFA0'
+}
+
+// linkHost returns the host of a URL, or of the domain at the start of a URL without a scheme, in its lowercase
+// unicode form, normalised in the same way as by LinkPolicy. Returns "" if there is no host.
+func linkHost(link string) string {
+	host, ok := bareDomain(link)
+	if !ok {
+		u, err := url.Parse(link)
+		if err != nil || u.Host == "" {
+			return ""
+		}
+		host = u.Hostname()
+	}
+	return strings.TrimSuffix(unicodeHost(host), ".")
+}
+
+// textHost returns the host named by a link's text, as with linkHost. Text without a scheme must end in a real top
+// level domain, so that file names such as main.go aren't mistaken for hosts.
+func textHost(text string) string {
+	host := linkHost(text)
+	if _, ok := bareDomain(text); !ok || host == "" {
+		return host
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return host
+	}
+	if _, icann := publicsuffix.PublicSuffix(ascii[strings.LastIndex(ascii, ".")+1:]); !icann {
+		return ""
+	}
+	return host
+}
+
+// unicodeHost converts a host to its lowercase unicode form, normalised as in a DNS lookup, so that it can be checked
+// for lookalike characters. Hosts which aren't valid domain names are only lowercased.
+func unicodeHost(host string) string {
+	if u, err := idna.Lookup.ToUnicode(host); err == nil {
+		return u
+	}
+	return strings.ToLower(idnDots.Replace(host))
+}
+
+// sameSite reports whether the hosts are the same, or have the same registrable domain; eg bank.com and www.bank.com,
+// but not bank.co.uk and evil.co.uk, since anyone can register a domain under co.uk. IP addresses must be the same.
+func sameSite(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	siteA, okA := registrableDomain(a)
+	siteB, okB := registrableDomain(b)
+	return okA && okB && siteA == siteB
+}
+
+// registrableDomain returns the part of the host which its owner registered, below the public suffix; eg bank.co.uk for
+// www.bank.co.uk.
+func registrableDomain(host string) (string, bool) {
+	if host == "" || net.ParseIP(host) != nil {
+		return "", false
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", false
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(ascii)
+	return site, err == nil
+}
+
+// lookalikeScripts are the scripts whose letters are commonly mistaken for each other.
+var lookalikeScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Greek", unicode.Greek},
+	{"Armenian", unicode.Armenian},
+	{"Cherokee", unicode.Cherokee},
+}
+
+// usedLookalikeScripts returns the lookalike scripts used by the letters of the label.
+func usedLookalikeScripts(label string) []string {
+	var used []string
+	for _, s := range lookalikeScripts {
+		if strings.IndexFunc(label, func(r rune) bool { return unicode.Is(s.table, r) }) >= 0 {
+			used = append(used, s.name)
+		}
+	}
+	return used
+}
+
+// homoglyphs maps non-Latin letters to the Latin letters they look like, based on Unicode's confusables. Hosts are
+// normalised before they are checked, so only the lowercase letters which idna keeps are needed.
+var homoglyphs = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'ь': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'ҽ': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'ӏ': 'l',
+	'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ү': 'y', 'ё': 'ë', 'ї': 'ï',
+	'ӧ': 'ö',
+	// Greek
+	'α': 'a', 'ι': 'i', 'ϳ': 'j', 'κ': 'k', 'η': 'n', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'ν': 'v',
+	'ω': 'w', 'χ': 'x', 'γ': 'y',
+	// Armenian
+	'ց': 'g', 'հ': 'h', 'ո': 'n', 'օ': 'o', 'զ': 'q', 'ս': 'u', 'ա': 'w',
+}
+
+// homoglyphSkeleton returns the Latin text that a label looks like, if all its letters are non-Latin lookalikes.
+func homoglyphSkeleton(label string) (string, bool) {
+	if isASCII(label) {
+		return "", false
+	}
+	skeleton := []rune(label)
+	for idx, r := range skeleton {
+		if latin, ok := homoglyphs[r]; ok {
+			skeleton[idx] = latin
+		} else if unicode.IsLetter(r) {
+			return "", false
+		}
+	}
+	return string(skeleton), true
+}
+
+func isASCII(s string) bool {
+	for idx := range len(s) {
+		if s[idx] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
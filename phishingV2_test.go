@@ -0,0 +1,151 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestAnalyzeLinksV2(t *testing.T) {
+	for _, x := range []struct {
+		name     string
+		in       string
+		findings []tg_md2html.Finding
+	}{
+		{
+			name: "matching text",
+			in:   "[https://bank.com](https://www.bank.com/login) [Bank.com](https://bank.com) [my bank](https://evil.example)",
+		}, {
+			name: "file names",
+			in:   "[main.go](https://github.com/x/y/blob/main/main.go) [config.yaml](https://example.com/config.yaml)",
+		}, {
+			name: "mismatched url",
+			in:   "Log in at [https://bank.com](https://evil.example/bank)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "https://bank.com",
+				URL:     "https://evil.example/bank",
+				Host:    "bank.com",
+				Message: "link text names bank.com, but the link goes to evil.example",
+			}},
+		}, {
+			name: "mismatched domain",
+			in:   "*[bank.com/login](https://bank.com.evil.example)*",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "bank.com/login",
+				URL:     "https://bank.com.evil.example",
+				Host:    "bank.com",
+				Message: "link text names bank.com, but the link goes to bank.com.evil.example",
+			}},
+		}, {
+			name: "zero width characters",
+			in:   "[bank\u200b.com](https://bank.com)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingInvisibleChars,
+				Text:    "bank\u200b.com",
+				URL:     "https://bank.com",
+				Message: `link text "bank.com" contains invisible characters`,
+			}},
+		}, {
+			name: "mixed script",
+			in:   "[pay here](https://bаnk.com)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMixedScript,
+				Text:    "pay here",
+				URL:     "https://bаnk.com",
+				Host:    "bаnk.com",
+				Message: `"bаnk" mixes Latin and Cyrillic letters`,
+			}},
+		}, {
+			name: "homoglyph punycode",
+			in:   "[apple.com](https://xn--80ak6aa92e.com)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "apple.com",
+				URL:     "https://xn--80ak6aa92e.com",
+				Host:    "apple.com",
+				Message: "link text names apple.com, but the link goes to аррӏе.com",
+			}, {
+				Kind:    tg_md2html.FindingHomoglyph,
+				Text:    "apple.com",
+				URL:     "https://xn--80ak6aa92e.com",
+				Host:    "аррӏе.com",
+				Message: `"аррӏе" looks like "apple"`,
+			}},
+		}, {
+			name: "same public suffix",
+			in:   "[bank.co.uk](https://evil.co.uk) [alice.github.io](https://bob.github.io) [www.bank.co.uk](https://bank.co.uk)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "bank.co.uk",
+				URL:     "https://evil.co.uk",
+				Host:    "bank.co.uk",
+				Message: "link text names bank.co.uk, but the link goes to evil.co.uk",
+			}, {
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "alice.github.io",
+				URL:     "https://bob.github.io",
+				Host:    "alice.github.io",
+				Message: "link text names alice.github.io, but the link goes to bob.github.io",
+			}},
+		}, {
+			name: "fullwidth text",
+			in:   "[ｇｉｔｈｕｂ．ｃｏｍ](https://github.com) [ＧＯＯＧＬＥ.com](https://evil.example)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "ＧＯＯＧＬＥ.com",
+				URL:     "https://evil.example",
+				Host:    "google.com",
+				Message: "link text names google.com, but the link goes to evil.example",
+			}},
+		}, {
+			name: "homoglyph text",
+			in:   "[аррӏе.com](https://аррӏе.com) [κοοκ.com](https://kook.com)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingHomoglyph,
+				Text:    "аррӏе.com",
+				URL:     "https://аррӏе.com",
+				Host:    "аррӏе.com",
+				Message: `"аррӏе" looks like "apple"`,
+			}, {
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "κοοκ.com",
+				URL:     "https://kook.com",
+				Host:    "κοοκ.com",
+				Message: "link text names κοοκ.com, but the link goes to kook.com",
+			}, {
+				Kind:    tg_md2html.FindingHomoglyph,
+				Text:    "κοοκ.com",
+				URL:     "https://kook.com",
+				Host:    "κοοκ.com",
+				Message: `"κοοκ" looks like "kook"`,
+			}},
+		}, {
+			name: "non-latin domain",
+			in:   "[пример.испытание](https://xn--e1afmkfd.xn--80akhbyknj4f)",
+		}, {
+			name: "button",
+			in:   "Hi\n[https://bank.com](buttonurl://evil.example)",
+			findings: []tg_md2html.Finding{{
+				Kind:    tg_md2html.FindingMismatchedHost,
+				Text:    "https://bank.com",
+				URL:     "evil.example",
+				Button:  true,
+				Host:    "bank.com",
+				Message: "link text names bank.com, but the link goes to evil.example",
+			}},
+		}, {
+			name: "mentions aren't links",
+			in:   "[bank.com](tg://user?id=123)",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			findings, err := tg_md2html.AnalyzeLinksV2(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, x.findings, findings)
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reply keyboard button types, matching telegram's keyboard buttons. Web app buttons use ButtonTypeWebApp.
+// https://core.telegram.org/bots/api#keyboardbutton
+const (
+	ReplyButtonTypeText     = "reply_text"
+	ReplyButtonTypeContact  = "request_contact"
+	ReplyButtonTypeLocation = "request_location"
+	ReplyButtonTypePoll     = "request_poll"
+	ReplyButtonTypeUsers    = "request_users"
+	ReplyButtonTypeChat     = "request_chat"
+)
+
+// Poll types which can be set on a request_poll button.
+const (
+	PollTypeQuiz    = "quiz"
+	PollTypeRegular = "regular"
+)
+
+// MaxInputFieldPlaceholderLength is the maximum length of a reply keyboard's placeholder, in characters.
+const MaxInputFieldPlaceholderLength = 64
+
+// Telegram's limits on the size of a reply keyboard.
+const (
+	MaxReplyKeyboardButtons  = 300
+	MaxReplyKeyboardRowWidth = 12
+)
+
+// DefaultReplyKeyboardPrefix is the ReplyKeyboardPrefix used by MD2HTMLReplyKeyboardV2.
+const DefaultReplyKeyboardPrefix = "replykeyboard"
+
+// DefaultReplyPrefixes returns the ReplyPrefixes used by MD2HTMLReplyKeyboardV2. The default converter doesn't parse
+// reply buttons, so that they are kept as links by MD2HTMLButtonsV2; set ConverterV2.ReplyPrefixes to use them.
+func DefaultReplyPrefixes() map[string]string {
+	return map[string]string{
+		ReplyButtonTypeText:     "replytext",
+		ReplyButtonTypeContact:  "replycontact",
+		ReplyButtonTypeLocation: "replylocation",
+		ReplyButtonTypePoll:     "replypoll",
+		ReplyButtonTypeUsers:    "replyusers",
+		ReplyButtonTypeChat:     "replychat",
+		ButtonTypeWebApp:        "replywebapp",
+	}
+}
+
+// replyKeyboardConverterV2 is the default converter, with the default reply keyboard syntax.
+var replyKeyboardConverterV2 = func() ConverterV2 {
+	cv := defaultConverterV2
+	cv.ReplyPrefixes = DefaultReplyPrefixes()
+	cv.ReplyKeyboardPrefix = DefaultReplyKeyboardPrefix
+	return cv
+}()
+
+// MaxRequestUsersQuantity is the maximum number of users a request_users button can ask for.
+const MaxRequestUsersQuantity = 10
+
+// ReplyKeyboardOptions are the keyboard-level options of a reply keyboard.
+// The markdown syntax for the options is as such, where the placeholder is optional, and the options are any of
+// "resize", "one_time", "persistent" and "selective":
+// [<placeholder>](<prefix>:<option>,<option>)
+type ReplyKeyboardOptions struct {
+	// Placeholder is shown in the input field while the keyboard is active.
+	Placeholder string
+	Resize      bool
+	OneTime     bool
+	Persistent  bool
+	Selective   bool
+	// Err is set when the options are invalid, such as an unknown option or a placeholder which is too long.
+	Err error
+}
+
+// ReplyKeyboardMarkup is a reply keyboard, as sent to telegram in a message's reply_markup.
+// https://core.telegram.org/bots/api#replykeyboardmarkup
+type ReplyKeyboardMarkup struct {
+	Keyboard              [][]KeyboardButton `json:"keyboard"`
+	IsPersistent          bool               `json:"is_persistent,omitempty"`
+	ResizeKeyboard        bool               `json:"resize_keyboard,omitempty"`
+	OneTimeKeyboard       bool               `json:"one_time_keyboard,omitempty"`
+	InputFieldPlaceholder string             `json:"input_field_placeholder,omitempty"`
+	Selective             bool               `json:"selective,omitempty"`
+}
+
+// KeyboardButton is a reply keyboard button, as sent to telegram. Buttons with none of the optional fields set send
+// their text.
+type KeyboardButton struct {
+	Text              string                      `json:"text"`
+	Style             string                      `json:"style,omitempty"`
+	IconCustomEmojiID string                      `json:"icon_custom_emoji_id,omitempty"`
+	RequestUsers      *KeyboardButtonRequestUsers `json:"request_users,omitempty"`
+	RequestChat       *KeyboardButtonRequestChat  `json:"request_chat,omitempty"`
+	RequestContact    bool                        `json:"request_contact,omitempty"`
+	RequestLocation   bool                        `json:"request_location,omitempty"`
+	RequestPoll       *KeyboardButtonPollType     `json:"request_poll,omitempty"`
+	WebApp            *WebAppInfo                 `json:"web_app,omitempty"`
+}
+
+// KeyboardButtonPollType is the type of poll a request_poll button creates. An empty type allows any poll.
+type KeyboardButtonPollType struct {
+	Type string `json:"type,omitempty"`
+}
+
+// KeyboardButtonRequestUsers is the criteria used by a request_users button. In markdown, its content is the request
+// ID, followed by any of the other fields as a query; eg "1?max_quantity=3&user_is_bot=false".
+type KeyboardButtonRequestUsers struct {
+	RequestID       int32 `json:"request_id"`
+	UserIsBot       *bool `json:"user_is_bot,omitempty"`
+	UserIsPremium   *bool `json:"user_is_premium,omitempty"`
+	MaxQuantity     int   `json:"max_quantity,omitempty"`
+	RequestName     bool  `json:"request_name,omitempty"`
+	RequestUsername bool  `json:"request_username,omitempty"`
+	RequestPhoto    bool  `json:"request_photo,omitempty"`
+}
+
+// KeyboardButtonRequestChat is the criteria used by a request_chat button. In markdown, its content is the request ID,
+// followed by any of the other fields as a query; eg "1?chat_is_channel=true".
+type KeyboardButtonRequestChat struct {
+	RequestID       int32 `json:"request_id"`
+	ChatIsChannel   bool  `json:"chat_is_channel"`
+	ChatIsForum     *bool `json:"chat_is_forum,omitempty"`
+	ChatHasUsername *bool `json:"chat_has_username,omitempty"`
+	ChatIsCreated   bool  `json:"chat_is_created,omitempty"`
+	BotIsMember     bool  `json:"bot_is_member,omitempty"`
+	RequestTitle    bool  `json:"request_title,omitempty"`
+	RequestUsername bool  `json:"request_username,omitempty"`
+	RequestPhoto    bool  `json:"request_photo,omitempty"`
+}
+
+// MD2HTMLReplyKeyboardV2 converts markdown to HTML and a reply keyboard, using the default converter with the
+// DefaultReplyPrefixes and DefaultReplyKeyboardPrefix.
+func MD2HTMLReplyKeyboardV2(in string) (string, *ReplyKeyboardMarkup, error) {
+	return replyKeyboardConverterV2.MD2HTMLReplyKeyboard(in)
+}
+
+// MD2HTMLReplyKeyboard converts markdown to HTML, and builds the reply keyboard defined in it with the ReplyPrefixes
+// and ReplyKeyboardPrefix. Inline buttons are dropped. The keyboard is nil if the text has no reply buttons.
+func (cv ConverterV2) MD2HTMLReplyKeyboard(in string) (string, *ReplyKeyboardMarkup, error) {
+	doc := cv.parse(in, true)
+	kb, err := cv.ReplyKeyboard(doc.ReplyButtons(), doc.ReplyKeyboardOptions())
+	if err != nil {
+		return "", nil, err
+	}
+	return cv.Render(doc), kb, nil
+}
+
+// ReplyKeyboard lays out reply buttons into a keyboard, starting a new row for each button which isn't SameLine.
+// The options may be nil. An empty list of buttons returns a nil keyboard, unless the options are invalid.
+func (cv ConverterV2) ReplyKeyboard(btns []ButtonV2, opts *ReplyKeyboardOptions) (*ReplyKeyboardMarkup, error) {
+	if opts != nil && opts.Err != nil {
+		return nil, opts.Err
+	}
+	if len(btns) == 0 {
+		return nil, nil
+	}
+
+	kb := &ReplyKeyboardMarkup{}
+	if opts != nil {
+		kb.InputFieldPlaceholder = opts.Placeholder
+		kb.ResizeKeyboard = opts.Resize
+		kb.OneTimeKeyboard = opts.OneTime
+		kb.IsPersistent = opts.Persistent
+		kb.Selective = opts.Selective
+	}
+
+	for idx, btn := range btns {
+		kbtn, err := cv.KeyboardButton(btn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid button %d (%s): %w", idx, btn.Name, err)
+		}
+		if idx == 0 || !btn.SameLine {
+			kb.Keyboard = append(kb.Keyboard, nil)
+		}
+		kb.Keyboard[len(kb.Keyboard)-1] = append(kb.Keyboard[len(kb.Keyboard)-1], kbtn)
+	}
+	if err := kb.Validate(); err != nil {
+		return nil, err
+	}
+	return kb, nil
+}
+
+// Validate checks that the keyboard is within telegram's limits.
+func (kb *ReplyKeyboardMarkup) Validate() error {
+	count := 0
+	for r, row := range kb.Keyboard {
+		if len(row) == 0 {
+			return fmt.Errorf("%w: row %d is empty", ErrInvalidKeyboard, r)
+		}
+		if len(row) > MaxReplyKeyboardRowWidth {
+			return fmt.Errorf("%w: row %d has %d buttons, the maximum is %d", ErrInvalidKeyboard, r, len(row), MaxReplyKeyboardRowWidth)
+		}
+		count += len(row)
+	}
+	if count > MaxReplyKeyboardButtons {
+		return fmt.Errorf("%w: %d buttons, the maximum is %d", ErrInvalidKeyboard, count, MaxReplyKeyboardButtons)
+	}
+	return nil
+}
+
+// ReplyButtons returns the keyboard's buttons and options, with SameLine set for all but the first button of each row.
+// They can be written back to markdown with ReplyButtonToMarkdown and ReplyKeyboardOptionsToMarkdown.
+func (cv ConverterV2) ReplyButtons(kb *ReplyKeyboardMarkup) ([]ButtonV2, *ReplyKeyboardOptions, error) {
+	if kb == nil {
+		return nil, nil, nil
+	}
+	if err := kb.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	var btns []ButtonV2
+	for _, row := range kb.Keyboard {
+		for idx, kbtn := range row {
+			btn, err := cv.ReplyButton(kbtn)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid button %d (%s): %w", len(btns), kbtn.Text, err)
+			}
+			btn.SameLine = idx > 0
+			btns = append(btns, btn)
+		}
+	}
+
+	opts := &ReplyKeyboardOptions{
+		Placeholder: kb.InputFieldPlaceholder,
+		Resize:      kb.ResizeKeyboard,
+		OneTime:     kb.OneTimeKeyboard,
+		Persistent:  kb.IsPersistent,
+		Selective:   kb.Selective,
+	}
+	if *opts == (ReplyKeyboardOptions{}) {
+		opts = nil
+	}
+	return btns, opts, nil
+}
+
+// KeyboardButton converts a parsed reply button to its typed form, mapping its style to the telegram value.
+func (cv ConverterV2) KeyboardButton(btn ButtonV2) (KeyboardButton, error) {
+	if btn.Name == "" || (btn.Content == "" && buttonNeedsContent(btn.Type)) {
+		return KeyboardButton{}, ErrNoButtonContent
+	}
+	if err := btn.Validate(); err != nil {
+		return KeyboardButton{}, err
+	}
+
+	style, err := cv.telegramStyle(btn.Style)
+	if err != nil {
+		return KeyboardButton{}, err
+	}
+
+	kbtn := KeyboardButton{Text: btn.Name, Style: style, IconCustomEmojiID: btn.Icon}
+	content := html.UnescapeString(btn.Content)
+	switch btn.Type {
+	case ReplyButtonTypeText:
+	case ReplyButtonTypeContact:
+		kbtn.RequestContact = true
+	case ReplyButtonTypeLocation:
+		kbtn.RequestLocation = true
+	case ReplyButtonTypePoll:
+		kbtn.RequestPoll = &KeyboardButtonPollType{Type: content}
+	case ReplyButtonTypeUsers:
+		kbtn.RequestUsers, _ = parseRequestUsers(content) // Already checked by Validate.
+	case ReplyButtonTypeChat:
+		kbtn.RequestChat, _ = parseRequestChat(content)
+	case ButtonTypeWebApp:
+		kbtn.WebApp = &WebAppInfo{URL: content}
+	default:
+		return KeyboardButton{}, fmt.Errorf("%w: %q is not a reply keyboard button type", ErrInvalidButton, btn.Type)
+	}
+	return kbtn, nil
+}
+
+// ReplyButton converts a typed reply button back to a ButtonV2, which can then be written with ReplyButtonToMarkdown.
+func (cv ConverterV2) ReplyButton(kbtn KeyboardButton) (ButtonV2, error) {
+	btn := ButtonV2{Name: kbtn.Text, Icon: kbtn.IconCustomEmojiID}
+	switch {
+	case kbtn.RequestContact:
+		btn.Type = ReplyButtonTypeContact
+	case kbtn.RequestLocation:
+		btn.Type = ReplyButtonTypeLocation
+	case kbtn.RequestPoll != nil:
+		btn.Type, btn.Content = ReplyButtonTypePoll, kbtn.RequestPoll.Type
+	case kbtn.RequestUsers != nil:
+		btn.Type, btn.Content = ReplyButtonTypeUsers, formatRequestUsers(kbtn.RequestUsers)
+	case kbtn.RequestChat != nil:
+		btn.Type, btn.Content = ReplyButtonTypeChat, formatRequestChat(kbtn.RequestChat)
+	case kbtn.WebApp != nil:
+		btn.Type, btn.Content = ButtonTypeWebApp, kbtn.WebApp.URL
+	default:
+		btn.Type = ReplyButtonTypeText
+	}
+	btn.Content = html.EscapeString(btn.Content)
+
+	style, err := cv.styleName(kbtn.Style)
+	if err != nil {
+		return ButtonV2{}, err
+	}
+	btn.Style = style
+	return btn, btn.Validate()
+}
+
+// ReplyKeyboardOptionsToMarkdown converts reply keyboard options back to markdown, using the ReplyKeyboardPrefix.
+func (cv ConverterV2) ReplyKeyboardOptionsToMarkdown(opts ReplyKeyboardOptions) (string, error) {
+	if cv.ReplyKeyboardPrefix == "" {
+		return "", fmt.Errorf("%w: no reply keyboard prefix", ErrInvalidButton)
+	}
+	if opts.Err != nil {
+		return "", opts.Err
+	}
+
+	var options []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"resize", opts.Resize},
+		{"one_time", opts.OneTime},
+		{"persistent", opts.Persistent},
+		{"selective", opts.Selective},
+	} {
+		if o.set {
+			options = append(options, o.name)
+		}
+	}
+	return "[" + cv.EscapeMarkdown([]rune(opts.Placeholder)) + "](" + cv.ReplyKeyboardPrefix + "://" + strings.Join(options, ",") + ")", nil
+}
+
+// getReplyKeyboardOptions checks whether a link's content uses the reply keyboard prefix, and returns the options if so.
+func (cv ConverterV2) getReplyKeyboardOptions(text []rune, content string) (ReplyKeyboardOptions, bool) {
+	pref, options, ok := strings.Cut(content, ":")
+	if !ok || cv.ReplyKeyboardPrefix == "" || pref != cv.ReplyKeyboardPrefix {
+		return ReplyKeyboardOptions{}, false
+	}
+
+	opts := ReplyKeyboardOptions{Placeholder: html.UnescapeString(cv.StripMDV2(string(text)))}
+	if l := utf8.RuneCountInString(opts.Placeholder); l > MaxInputFieldPlaceholderLength {
+		opts.Err = fmt.Errorf("%w: reply keyboard placeholder must be at most %d characters, got %d",
+			ErrInvalidKeyboard, MaxInputFieldPlaceholderLength, l)
+	}
+	for _, o := range strings.Split(strings.TrimLeft(options, "/"), ",") {
+		switch strings.TrimSpace(o) {
+		case "":
+		case "resize":
+			opts.Resize = true
+		case "one_time":
+			opts.OneTime = true
+		case "persistent":
+			opts.Persistent = true
+		case "selective":
+			opts.Selective = true
+		default:
+			if opts.Err == nil {
+				opts.Err = fmt.Errorf("%w: unknown reply keyboard option %q", ErrInvalidKeyboard, html.UnescapeString(o))
+			}
+		}
+	}
+	return opts, true
+}
+
+// requestQuery reads the query of a request_users or request_chat button's content. The first error found is kept.
+type requestQuery struct {
+	values url.Values
+	err    error
+}
+
+// parseRequestQuery splits a button's content into its request ID and query, and checks that the query only uses
+// known fields.
+func parseRequestQuery(content string, known ...string) (int32, *requestQuery, error) {
+	id, query, _ := strings.Cut(content, "?")
+	requestID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("request id %q is not a number", id)
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad request query %q: %w", query, err)
+	}
+	for k := range values {
+		if !slices.Contains(known, k) {
+			return 0, nil, fmt.Errorf("unknown request field %q", k)
+		}
+	}
+	return int32(requestID), &requestQuery{values: values}, nil
+}
+
+func (q *requestQuery) optionalBool(key string) *bool {
+	if !q.values.Has(key) {
+		return nil
+	}
+	b := q.bool(key)
+	return &b
+}
+
+func (q *requestQuery) bool(key string) bool {
+	if !q.values.Has(key) || q.err != nil {
+		return false
+	}
+	b, err := strconv.ParseBool(q.values.Get(key))
+	if err != nil {
+		q.err = fmt.Errorf("request field %s must be true or false, got %q", key, q.values.Get(key))
+	}
+	return b
+}
+
+func parseRequestUsers(content string) (*KeyboardButtonRequestUsers, error) {
+	id, q, err := parseRequestQuery(content,
+		"user_is_bot", "user_is_premium", "max_quantity", "request_name", "request_username", "request_photo")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &KeyboardButtonRequestUsers{
+		RequestID:       id,
+		UserIsBot:       q.optionalBool("user_is_bot"),
+		UserIsPremium:   q.optionalBool("user_is_premium"),
+		RequestName:     q.bool("request_name"),
+		RequestUsername: q.bool("request_username"),
+		RequestPhoto:    q.bool("request_photo"),
+	}
+	if q.values.Has("max_quantity") {
+		r.MaxQuantity, err = strconv.Atoi(q.values.Get("max_quantity"))
+		if err != nil || r.MaxQuantity < 1 || r.MaxQuantity > MaxRequestUsersQuantity {
+			return nil, fmt.Errorf("request field max_quantity must be 1-%d, got %q", MaxRequestUsersQuantity, q.values.Get("max_quantity"))
+		}
+	}
+	return r, q.err
+}
+
+func parseRequestChat(content string) (*KeyboardButtonRequestChat, error) {
+	id, q, err := parseRequestQuery(content,
+		"chat_is_channel", "chat_is_forum", "chat_has_username", "chat_is_created", "bot_is_member",
+		"request_title", "request_username", "request_photo")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &KeyboardButtonRequestChat{
+		RequestID:       id,
+		ChatIsChannel:   q.bool("chat_is_channel"),
+		ChatIsForum:     q.optionalBool("chat_is_forum"),
+		ChatHasUsername: q.optionalBool("chat_has_username"),
+		ChatIsCreated:   q.bool("chat_is_created"),
+		BotIsMember:     q.bool("bot_is_member"),
+		RequestTitle:    q.bool("request_title"),
+		RequestUsername: q.bool("request_username"),
+		RequestPhoto:    q.bool("request_photo"),
+	}
+	return r, q.err
+}
+
+// formatRequestQuery writes a request ID and query back to a button's content. Unset fields are left out.
+func formatRequestQuery(id int32, values url.Values) string {
+	if len(values) == 0 {
+		return strconv.FormatInt(int64(id), 10)
+	}
+	return strconv.FormatInt(int64(id), 10) + "?" + values.Encode()
+}
+
+func setBool(values url.Values, key string, b *bool) {
+	if b != nil {
+		values.Set(key, strconv.FormatBool(*b))
+	}
+}
+
+func setFlag(values url.Values, key string, b bool) {
+	if b {
+		values.Set(key, "true")
+	}
+}
+
+func formatRequestUsers(r *KeyboardButtonRequestUsers) string {
+	values := url.Values{}
+	setBool(values, "user_is_bot", r.UserIsBot)
+	setBool(values, "user_is_premium", r.UserIsPremium)
+	if r.MaxQuantity != 0 {
+		values.Set("max_quantity", strconv.Itoa(r.MaxQuantity))
+	}
+	setFlag(values, "request_name", r.RequestName)
+	setFlag(values, "request_username", r.RequestUsername)
+	setFlag(values, "request_photo", r.RequestPhoto)
+	return formatRequestQuery(r.RequestID, values)
+}
+
+func formatRequestChat(r *KeyboardButtonRequestChat) string {
+	values := url.Values{}
+	setFlag(values, "chat_is_channel", r.ChatIsChannel)
+	setBool(values, "chat_is_forum", r.ChatIsForum)
+	setBool(values, "chat_has_username", r.ChatHasUsername)
+	setFlag(values, "chat_is_created", r.ChatIsCreated)
+	setFlag(values, "bot_is_member", r.BotIsMember)
+	setFlag(values, "request_title", r.RequestTitle)
+	setFlag(values, "request_username", r.RequestUsername)
+	setFlag(values, "request_photo", r.RequestPhoto)
+	return formatRequestQuery(r.RequestID, values)
+}
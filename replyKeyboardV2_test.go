@@ -0,0 +1,186 @@
+package tg_md2html_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestMD2HTMLReplyKeyboardV2(t *testing.T) {
+	text := "Welcome, please *share* your details."
+	options := "[Pick an option](replykeyboard://resize,one_time)"
+	replyButtons := []string{
+		"[Yes](replytext@5368324170671202286://)",
+		"[No](replytext#danger://:same)",
+		"[Share contact](replycontact://)",
+		"[Share location](replylocation://:same)",
+		"[New quiz](replypoll://quiz)",
+		"[Pick users](replyusers://1?max_quantity=3&user_is_bot=false)",
+		"[Pick channel](replychat://2?chat_is_channel=true)",
+		"[Open app](replywebapp://https://example.com/app)",
+	}
+	in := text + "\n" + options + "\n" + strings.Join(replyButtons, "\n") + "\n[Rules](buttonurl://example.com)"
+
+	cv := testConverter()
+	out, kb, err := cv.MD2HTMLReplyKeyboard(in)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Welcome, please <b>share</b> your details.", out)
+
+	j, err := json.Marshal(kb)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"keyboard": [
+			[{"text": "Yes", "icon_custom_emoji_id": "5368324170671202286"}, {"text": "No", "style": "danger"}],
+			[{"text": "Share contact", "request_contact": true}, {"text": "Share location", "request_location": true}],
+			[{"text": "New quiz", "request_poll": {"type": "quiz"}}],
+			[{"text": "Pick users", "request_users": {"request_id": 1, "max_quantity": 3, "user_is_bot": false}}],
+			[{"text": "Pick channel", "request_chat": {"request_id": 2, "chat_is_channel": true}}],
+			[{"text": "Open app", "web_app": {"url": "https://example.com/app"}}]
+		],
+		"resize_keyboard": true,
+		"one_time_keyboard": true,
+		"input_field_placeholder": "Pick an option"
+	}`, string(j))
+
+	// Inline buttons are returned separately.
+	res := cv.Convert(in)
+	assert.Equal(t, []tg_md2html.ButtonV2{{Name: "Rules", Type: "url", Content: "example.com"}}, res.Buttons)
+	assert.Len(t, res.ReplyButtons, len(replyButtons))
+
+	// A keyboard received from telegram converts back to the same buttons and options, and so to the same markdown.
+	var received tg_md2html.ReplyKeyboardMarkup
+	assert.NoError(t, json.Unmarshal(j, &received))
+	btns, opts, err := cv.ReplyButtons(&received)
+	assert.NoError(t, err)
+	assert.Equal(t, res.ReplyButtons, btns)
+	assert.Equal(t, res.ReplyOptions, opts)
+
+	md, err := cv.ReplyKeyboardOptionsToMarkdown(*opts)
+	assert.NoError(t, err)
+	assert.Equal(t, options, md)
+	for idx, btn := range btns {
+		md, err := cv.ReplyButtonToMarkdown(btn)
+		assert.NoError(t, err)
+		assert.Equal(t, replyButtons[idx], md)
+	}
+}
+
+func TestMD2HTMLReplyKeyboardV2Default(t *testing.T) {
+	in := "Hi\n[Yes](replytext://)"
+
+	// The default converter doesn't use reply buttons, so they are kept as links.
+	out, btns := tg_md2html.MD2HTMLButtonsV2(in)
+	assert.Equal(t, "Hi\n<a href=\"replytext://\">Yes</a>", out)
+	assert.Empty(t, btns)
+
+	out, kb, err := tg_md2html.MD2HTMLReplyKeyboardV2(in)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", out)
+	assert.Equal(t, &tg_md2html.ReplyKeyboardMarkup{Keyboard: [][]tg_md2html.KeyboardButton{{{Text: "Yes"}}}}, kb)
+}
+
+func TestReplyKeyboardV2Size(t *testing.T) {
+	cv := testConverter()
+	row := make([]tg_md2html.ButtonV2, tg_md2html.MaxReplyKeyboardRowWidth+1)
+	for idx := range row {
+		row[idx] = tg_md2html.ButtonV2{Name: "btn", Type: tg_md2html.ReplyButtonTypeText, SameLine: true}
+	}
+	_, err := cv.ReplyKeyboard(row, nil)
+	assert.ErrorIs(t, err, tg_md2html.ErrInvalidKeyboard)
+
+	_, err = cv.ReplyKeyboard(row[:tg_md2html.MaxReplyKeyboardRowWidth], nil)
+	assert.NoError(t, err)
+
+	many := make([]tg_md2html.ButtonV2, tg_md2html.MaxReplyKeyboardButtons+1)
+	for idx := range many {
+		many[idx] = tg_md2html.ButtonV2{Name: "btn", Type: tg_md2html.ReplyButtonTypeText}
+	}
+	_, err = cv.ReplyKeyboard(many, nil)
+	assert.ErrorIs(t, err, tg_md2html.ErrInvalidKeyboard)
+
+	_, _, err = cv.ReplyButtons(&tg_md2html.ReplyKeyboardMarkup{Keyboard: [][]tg_md2html.KeyboardButton{make([]tg_md2html.KeyboardButton, 13)}})
+	assert.ErrorIs(t, err, tg_md2html.ErrInvalidKeyboard)
+}
+
+func TestReplyKeyboardV2NoButtons(t *testing.T) {
+	cv := testConverter()
+	out, kb, err := cv.MD2HTMLReplyKeyboard("Hi\n[Type here](replykeyboard://resize)")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", out)
+	assert.Nil(t, kb)
+
+	// Invalid options are reported even when there are no buttons to use them.
+	_, kb, err = cv.MD2HTMLReplyKeyboard("Hi\n[](replykeyboard://resize,tiny)")
+	assert.ErrorIs(t, err, tg_md2html.ErrInvalidKeyboard)
+	assert.Nil(t, kb)
+}
+
+func TestMD2HTMLReplyKeyboardV2_errors(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		in   string
+		err  error
+		diag string
+	}{
+		{
+			name: "content on text button",
+			in:   "[Yes](replytext://yes)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: reply_text buttons have no content, got "yes"`,
+		}, {
+			name: "bad poll type",
+			in:   "[Poll](replypoll://survey)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: poll type must be "quiz" or "regular", got "survey"`,
+		}, {
+			name: "bad request id",
+			in:   "[Users](replyusers://me)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: request id "me" is not a number`,
+		}, {
+			name: "unknown request field",
+			in:   "[Chat](replychat://1?chat_is_group=true)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: unknown request field "chat_is_group"`,
+		}, {
+			name: "bad request bool",
+			in:   "[Chat](replychat://1?chat_is_channel=maybe)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: request field chat_is_channel must be true or false, got "maybe"`,
+		}, {
+			name: "too many users",
+			in:   "[Users](replyusers://1?max_quantity=11)",
+			err:  tg_md2html.ErrInvalidButton,
+			diag: `invalid button: request field max_quantity must be 1-10, got "11"`,
+		}, {
+			name: "unknown option",
+			in:   "[Yes](replytext://)\n[](replykeyboard://resize,tiny)",
+			err:  tg_md2html.ErrInvalidKeyboard,
+			diag: `invalid keyboard: unknown reply keyboard option "tiny"`,
+		}, {
+			name: "placeholder too long",
+			in:   "[Yes](replytext://)\n[" + strings.Repeat("a", 65) + "](replykeyboard://)",
+			err:  tg_md2html.ErrInvalidKeyboard,
+			diag: "invalid keyboard: reply keyboard placeholder must be at most 64 characters, got 65",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			cv := testConverter()
+			_, _, err := cv.MD2HTMLReplyKeyboard(x.in)
+			assert.ErrorIs(t, err, x.err)
+
+			_, _, diags, err := cv.MD2HTMLButtonsStrict(x.in)
+			assert.NoError(t, err)
+			if assert.Len(t, diags, 1) {
+				assert.Equal(t, tg_md2html.DiagnosticInvalidButton, diags[0].Kind)
+				assert.Equal(t, x.diag, diags[0].Message)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 var (
@@ -18,166 +19,328 @@ var (
 
 var languageCodeblock = regexp.MustCompile(`^(?s)<code class="language-(.*?)">(.*)</code>$`)
 
-func ReverseV2(in string, bs []ButtonV2) (string, error) {
-	return defaultConverterV2.Reverse(in, bs)
+func ReverseV2(in string, bs []ButtonV2, ds ...Directive) (string, error) {
+	return defaultConverterV2.Reverse(in, bs, ds...)
 }
 
-func (cv ConverterV2) Reverse(in string, bs []ButtonV2) (string, error) {
-	text, err := cv.reverse([]rune(in), bs)
-	return strings.TrimSpace(text), err
+// Reverse converts HTML back to markdown. Any buttons and directives are written after the text.
+func (cv ConverterV2) Reverse(in string, bs []ButtonV2, ds ...Directive) (string, error) {
+	doc, err := cv.ParseHTML(in)
+	if err != nil {
+		return "", err
+	}
+	return cv.reverseDocument(doc, bs, ds)
 }
 
-func (cv ConverterV2) reverse(in []rune, buttons []ButtonV2) (string, error) {
-	prev := 0
-	out := strings.Builder{}
-	for i := 0; i < len(in); i++ {
-		switch in[i] {
-		case '<':
-			c := getHTMLTagCloseIndex(in[i+1:])
-			if c < 0 {
-				// "no close tag"
-				return "", fmt.Errorf("no closing '>' for opening bracket at %d", i)
-			}
-			closeTag := i + c + 1
-			tagContent := string(in[i+1 : closeTag])
-			tagFields := strings.Fields(tagContent)
-			if len(tagFields) < 1 {
-				return "", fmt.Errorf("no tag name for HTML tag started at %d", i)
-			}
-			tagType := tagFields[0]
+func ReverseEntitiesV2(text string, entities []MessageEntity, bs []ButtonV2, ds ...Directive) (string, error) {
+	return defaultConverterV2.ReverseEntities(text, entities, bs, ds...)
+}
 
-			co, cc := getClosingTag(in[closeTag+1:], tagContent, tagType)
-			if co < 0 || cc < 0 {
-				// "no closing open"
-				return "", fmt.Errorf("no closing tag for HTML tag %q started at %d", tagType, i)
-			}
-			closingOpen, closingClose := closeTag+1+co, closeTag+1+cc
-			out.WriteString(html.UnescapeString(string(in[prev:i])))
+// ReverseEntities converts text and entities, as received from telegram, back to markdown.
+// The output is the same as calling Reverse on the equivalent HTML, except that empty entities are dropped, since
+// telegram never sends them; eg an empty mention or code block is kept by Reverse, but not by ReverseEntities.
+func (cv ConverterV2) ReverseEntities(text string, entities []MessageEntity, bs []ButtonV2, ds ...Directive) (string, error) {
+	doc, err := cv.ParseEntities(text, entities)
+	if err != nil {
+		return "", err
+	}
+	return cv.reverseDocument(doc, bs, ds)
+}
 
-			nested, err := cv.reverse(in[closeTag+1:closingOpen], nil)
-			if err != nil {
-				return "", err
-			}
+func (cv ConverterV2) reverseDocument(doc *Document, bs []ButtonV2, ds []Directive) (string, error) {
+	d := cv.delimiters()
+	if err := d.checkReverse(doc.Nodes); err != nil {
+		return "", err
+	}
+	out := strings.Builder{}
+	out.WriteString(cv.reverseNodes(d, doc.Nodes, textEdge{}, textEdge{}))
+	if err := cv.writeDirectives(&out, ds); err != nil {
+		return "", err
+	}
+	if err := cv.writeButtons(&out, bs); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
 
-			switch tagType {
-			case "b", "strong":
-				out.WriteString("*" + nested + "*")
-			case "i", "em":
-				out.WriteString("_" + nested + "_")
-			case "u", "ins":
-				out.WriteString("__" + nested + "__")
-			case "s", "strike", "del":
-				out.WriteString("~" + nested + "~")
-			case "code":
-				// code and pre don't look at nested values, because they're not parsed
-				out.WriteString("`" + html.UnescapeString(string(in[closeTag+1:closingOpen])) + "`")
-			case "pre":
-				// code and pre don't look at nested values, because they're not parsed
-				content := html.UnescapeString(string(in[closeTag+1 : closingOpen]))
-				m := languageCodeblock.FindStringSubmatch(content)
-				if len(m) > 0 {
-					// This <pre> block contains a <code class...> block; handle the language.
-					lang, code := m[1], m[2]
-					out.WriteString("```" + lang + "\n" + code + "```")
-				} else {
-					// This is a regular boring pre block
-					out.WriteString("```" + content + "```")
-				}
-			case "span":
-				// NOTE: All span tags are currently spoiler tags. This may change in the future.
-				if len(tagFields) < 2 {
-					return "", fmt.Errorf("span tag does not have enough fields %q", tagFields)
-				}
-
-				switch spanType := tagFields[1]; spanType {
-				case "class=\"tg-spoiler\"":
-					out.WriteString("||" + nested + "||")
-				default:
-					return "", fmt.Errorf("unknown span type %q", spanType)
-				}
-			case "a":
-				if link.MatchString(tagContent) {
-					matches := link.FindStringSubmatch(tagContent)
-					out.WriteString("[" + nested + "](" + matches[1] + ")")
-				} else {
-					return "", fmt.Errorf("badly formatted anchor tag %q", tagContent)
-				}
-			case "tg-emoji":
-				if customEmoji.MatchString(tagContent) {
-					matches := customEmoji.FindStringSubmatch(tagContent)
-					out.WriteString("![" + nested + "](tg://emoji?id=" + matches[1] + ")")
-				} else {
-					return "", fmt.Errorf("badly formatted anchor tag %q", tagContent)
-				}
-			case "blockquote":
-				if len(tagFields) == 2 && tagFields[1] == "expandable" {
-					out.WriteString("**>" + strings.Join(strings.Split(nested, "\n"), "\n>") + "||")
-				} else {
-					out.WriteString(">" + strings.Join(strings.Split(nested, "\n"), "\n>"))
-				}
-			case "tg-time":
-				var unix, format string
-				for _, tag := range tagFields[1:] {
-					fieldType, valueQuoted, ok := strings.Cut(tag, "=")
-					if !ok {
-						return "", fmt.Errorf("badly formatted tag %q", tag)
-					}
-
-					value, err := strconv.Unquote(valueQuoted)
-					if err != nil {
-						return "", fmt.Errorf("badly formatted tag %q", tag)
-					}
-
-					switch fieldType {
-					case "unix":
-						unix = value
-					case "format":
-						format = value
-					}
-				}
-				if format != "" {
-					out.WriteString("![" + nested + "](tg://time?unix=" + unix + "&format=" + format + ")")
-				} else {
-					out.WriteString("![" + nested + "](tg://time?unix=" + unix + ")")
-				}
-
-			default:
-				return "", fmt.Errorf("unknown tag %q", tagType)
+// reverseNodes converts document nodes back to markdown, using the delimiters in d; see checkReverse. open and close are
+// the markdown around the nodes, such as the delimiters of the entity containing them; see escapeText.
+func (cv ConverterV2) reverseNodes(d *delimiterSet, nodes []Node, open textEdge, close textEdge) string {
+	// Text is escaped last, once the markdown next to it is known.
+	parts := make([]string, len(nodes))
+	for idx, n := range nodes {
+		if _, ok := n.(*Text); !ok {
+			parts[idx] = cv.reverseNode(d, n)
+		}
+	}
+	for idx, n := range nodes {
+		t, ok := n.(*Text)
+		if !ok {
+			continue
+		}
+		before, after := open, close
+		for prev := idx - 1; prev >= 0; prev-- {
+			if r, ok := lastRune(parts[prev]); ok {
+				before = textEdge{r: r}
+				break
+			}
+		}
+		for next := idx + 1; next < len(parts); next++ {
+			if r, ok := firstRune(parts[next]); ok {
+				after = textEdge{r: r}
+				break
 			}
+		}
+		parts[idx] = d.escapeText(t.Value, before, after)
+	}
+	return strings.Join(parts, "")
+}
 
-			prev = closingClose + 1
-			i = closingClose
+// reverseNode converts a single node, other than text, back to markdown.
+func (cv ConverterV2) reverseNode(d *delimiterSet, n Node) string {
+	formatting := func(t EntityType, children []Node) string {
+		delim := d.reverse[t]
+		edge := textEdge{r: rune(delim[0]), delim: true}
+		return delim + cv.reverseNodes(d, children, edge, edge) + delim
+	}
+	inLink := func(children []Node) string {
+		return cv.reverseNodes(d, children, textEdge{r: '['}, textEdge{r: ']'})
+	}
 
-		case '\\', '_', '*', '~', '`', '[', ']', '(', ')', '>': // these all need to be escaped to ensure we retain the same message
-			out.WriteString(html.UnescapeString(string(in[prev:i])))
-			out.WriteRune('\\')
-			out.WriteRune(in[i])
-			prev = i + 1
+	switch n := n.(type) {
+	case *Bold:
+		return formatting(EntityBold, n.Children)
+	case *Italic:
+		return formatting(EntityItalic, n.Children)
+	case *Underline:
+		return formatting(EntityUnderline, n.Children)
+	case *Strike:
+		return formatting(EntityStrikethrough, n.Children)
+	case *Spoiler:
+		return formatting(EntitySpoiler, n.Children)
+	case *Code:
+		return "`" + n.Value + "`"
+	case *Pre:
+		if n.Language != "" {
+			return "```" + n.Language + "\n" + n.Value + "```"
+		}
+		return "```" + n.Value + "```"
+	case *Link:
+		return "[" + inLink(n.Children) + "](" + n.URL + ")"
+	case *Mention:
+		return "[" + inLink(n.Children) + "](" + mentionURL(n.UserID) + ")"
+	case *CustomEmoji, *Time, *SpecialLink:
+		h, data, nested := specialLink(n)
+		return "![" + inLink(nested) + "](" + h.URL(data) + ")"
+	case *Blockquote:
+		if n.Expandable {
+			// The "||" closing an expandable blockquote isn't a delimiter, so text can't merge into it.
+			nested := cv.reverseNodes(d, n.Children, textEdge{r: '>'}, textEdge{r: '|'})
+			return "**>" + strings.Join(strings.Split(nested, "\n"), "\n>") + "||"
 		}
+		nested := cv.reverseNodes(d, n.Children, textEdge{r: '>'}, textEdge{})
+		return ">" + strings.Join(strings.Split(nested, "\n"), "\n>")
 	}
-	out.WriteString(html.UnescapeString(string(in[prev:])))
+	// Buttons and directives are written separately, at the end of the text.
+	return ""
+}
+
+func firstRune(s string) (rune, bool) {
+	for _, r := range s {
+		return r, true
+	}
+	return 0, false
+}
+
+func lastRune(s string) (rune, bool) {
+	r, size := utf8.DecodeLastRuneInString(s)
+	return r, size > 0
+}
 
+func (cv ConverterV2) writeButtons(out *strings.Builder, buttons []ButtonV2) error {
 	for idx, btn := range buttons {
 		bText, err := cv.ButtonToMarkdown(btn)
 		if err != nil {
-			return "", fmt.Errorf("invalid button %d (%s): %w", idx, btn.Name, err)
+			return fmt.Errorf("invalid button %d (%s): %w", idx, btn.Name, err)
 		}
 		out.WriteString("\n" + bText)
 	}
+	return nil
+}
+
+// ParseHTML parses telegram-flavoured HTML, such as the output of MD2HTML, into a Document.
+func (cv ConverterV2) ParseHTML(in string) (*Document, error) {
+	nodes, err := cv.parseHTML([]rune(in))
+	if err != nil {
+		return nil, err
+	}
+	return &Document{Nodes: nodes}, nil
+}
+
+func (cv ConverterV2) parseHTML(in []rune) ([]Node, error) {
+	prev := 0
+	var nodes []Node
+	for i := 0; i < len(in); i++ {
+		if in[i] != '<' {
+			continue
+		}
+
+		c := getHTMLTagCloseIndex(in[i+1:])
+		if c < 0 {
+			// "no close tag"
+			return nil, fmt.Errorf("no closing '>' for opening bracket at %d", i)
+		}
+		closeTag := i + c + 1
+		tagContent := string(in[i+1 : closeTag])
+		tagFields := strings.Fields(tagContent)
+		if len(tagFields) < 1 {
+			return nil, fmt.Errorf("no tag name for HTML tag started at %d", i)
+		}
+		tagType := tagFields[0]
+
+		co, cc := getClosingTag(in[closeTag+1:], tagContent, tagType)
+		if co < 0 || cc < 0 {
+			// "no closing open"
+			return nil, fmt.Errorf("no closing tag for HTML tag %q started at %d", tagType, i)
+		}
+		closingOpen, closingClose := closeTag+1+co, closeTag+1+cc
+		nodes = appendHTMLText(nodes, in[prev:i])
+
+		n, err := cv.parseHTMLTag(tagType, tagContent, tagFields, in[closeTag+1:closingOpen])
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, cv.allowNode(n)...)
+
+		prev = closingClose + 1
+		i = closingClose
+	}
+	return appendHTMLText(nodes, in[prev:]), nil
+}
+
+func appendHTMLText(nodes []Node, in []rune) []Node {
+	if len(in) == 0 {
+		return nodes
+	}
+	return append(nodes, &Text{Value: html.UnescapeString(string(in))})
+}
+
+func (cv ConverterV2) parseHTMLTag(tagType string, tagContent string, tagFields []string, inner []rune) (Node, error) {
+	switch tagType {
+	case "code":
+		// code and pre don't look at nested values, because they're not parsed
+		return &Code{Value: cv.stripHTML(inner)}, nil
+	case "pre":
+		// code and pre don't look at nested values, because they're not parsed
+		m := languageCodeblock.FindStringSubmatch(string(inner))
+		if len(m) > 0 {
+			// This <pre> block contains a <code class...> block; handle the language.
+			return &Pre{Language: html.UnescapeString(m[1]), Value: cv.stripHTML([]rune(m[2]))}, nil
+		}
+		// This is a regular boring pre block
+		return &Pre{Value: cv.stripHTML(inner)}, nil
+	}
+
+	nested, err := cv.parseHTML(inner)
+	if err != nil {
+		return nil, err
+	}
+	if h, data, ok := cv.parseSpecialHTML(tagType, tagContent); ok {
+		return newSpecialLink(h, data, nested), nil
+	}
+
+	switch tagType {
+	case "b", "strong":
+		return &Bold{Children: nested}, nil
+	case "i", "em":
+		return &Italic{Children: nested}, nil
+	case "u", "ins":
+		return &Underline{Children: nested}, nil
+	case "s", "strike", "del":
+		return &Strike{Children: nested}, nil
+	case "tg-spoiler":
+		return &Spoiler{Children: nested}, nil
+	case "span":
+		// NOTE: All span tags are currently spoiler tags. This may change in the future.
+		if len(tagFields) < 2 {
+			return nil, fmt.Errorf("span tag does not have enough fields %q", tagFields)
+		}
+
+		switch spanType := tagFields[1]; spanType {
+		case "class=\"tg-spoiler\"":
+			return &Spoiler{Children: nested}, nil
+		default:
+			return nil, fmt.Errorf("unknown span type %q", spanType)
+		}
+	case "a":
+		href, ok := getHTMLAttr(tagContent, "href")
+		if !ok {
+			return nil, fmt.Errorf("badly formatted anchor tag %q", tagContent)
+		}
+		return newLink(href, nested), nil
+	case "tg-emoji":
+		id, ok := getHTMLAttr(tagContent, "emoji-id")
+		if !ok {
+			return nil, fmt.Errorf("badly formatted anchor tag %q", tagContent)
+		}
+		return &CustomEmoji{ID: id, Children: nested}, nil
+	case "blockquote":
+		return &Blockquote{Expandable: len(tagFields) == 2 && tagFields[1] == "expandable", Children: nested}, nil
+	case "tg-time":
+		unix, ok := getHTMLAttr(tagContent, "unix")
+		if !ok {
+			return nil, fmt.Errorf("badly formatted tag %q", tagContent)
+		}
+		unixTime, err := strconv.ParseInt(unix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("badly formatted unix time %q: %w", unix, err)
+		}
+		format, _ := getHTMLAttr(tagContent, "format")
+		return &Time{Unix: unixTime, Format: format, Children: nested}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown tag %q", tagType)
+	}
+}
 
-	return out.String(), nil
+// getHTMLAttr returns the unescaped value of a quoted attribute in the tag.
+func getHTMLAttr(tagContent string, name string) (string, bool) {
+	for _, quote := range []string{`"`, "'"} {
+		_, rest, ok := strings.Cut(tagContent, " "+name+"="+quote)
+		if !ok {
+			continue
+		}
+		value, _, ok := strings.Cut(rest, quote)
+		if !ok {
+			return "", false
+		}
+		return html.UnescapeString(value), true
+	}
+	return "", false
 }
 
 func (cv ConverterV2) ButtonToMarkdown(btn ButtonV2) (string, error) {
+	return cv.buttonToMarkdown(cv.Prefixes, btn)
+}
+
+// ReplyButtonToMarkdown converts a reply keyboard button back to markdown, using the converter's ReplyPrefixes.
+func (cv ConverterV2) ReplyButtonToMarkdown(btn ButtonV2) (string, error) {
+	return cv.buttonToMarkdown(cv.ReplyPrefixes, btn)
+}
+
+func (cv ConverterV2) buttonToMarkdown(prefixes map[string]string, btn ButtonV2) (string, error) {
 	sameline := ""
 	if btn.SameLine {
 		sameline = cv.SameLineSuffix
 	}
 
-	prefix, ok := cv.Prefixes[btn.Type]
-	if !ok || btn.Name == "" || btn.Content == "" {
+	prefix, ok := prefixes[btn.Type]
+	if !ok || btn.Name == "" || (btn.Content == "" && buttonNeedsContent(btn.Type)) {
 		return "", ErrNoButtonContent
 	}
+	if err := btn.Validate(); err != nil {
+		return "", err
+	}
 
 	if btn.Style != "" {
 		trn, ok := cv.Styles[btn.Style]
@@ -189,6 +352,9 @@ func (cv ConverterV2) ButtonToMarkdown(btn ButtonV2) (string, error) {
 
 		prefix += "#" + trn
 	}
+	if btn.Icon != "" {
+		prefix += "@" + btn.Icon
+	}
 
-	return "[" + EscapeMarkdownV2([]rune(btn.Name)) + "](" + prefix + "://" + html.UnescapeString(btn.Content) + sameline + ")", nil
+	return "[" + cv.EscapeMarkdown([]rune(btn.Name)) + "](" + prefix + "://" + html.UnescapeString(btn.Content) + sameline + ")", nil
 }
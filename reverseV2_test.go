@@ -1,6 +1,7 @@
 package tg_md2html_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,9 +35,15 @@ func TestReverseV2(t *testing.T) {
 		"![22:45 tomorrow](tg://time?unix=1647531900&format=t)",   // timestamps
 		"![22:45 tomorrow](tg://time?unix=1647531900&format=r)",   // timestamps
 		"![22:45 tomorrow](tg://time?unix=1647531900)",            // timestamps
-		"> ",             // empty quotes
-		"test\n>\ntest",  // multiline quotes
-		"||||||||| test", // nested spoilers
+		"> ",                       // empty quotes
+		"test\n>\ntest",            // multiline quotes
+		"||||||||| test",           // nested spoilers
+		"||||||a",                  // spoilers of pipes
+		"||\\|x\\|||",              // spoilers starting and ending with pipes
+		"a\\|||b|| \\|",            // pipes next to spoilers
+		"a | b \\|\\| c",           // pipes in text
+		"x ||a|| || y",             // pipes after spoilers
+		"**>quote \\|\n>end \\|||", // pipes at the end of expandable blockquotes
 	} {
 		t.Run(test, func(t *testing.T) {
 			htmlv2 := tg_md2html.MD2HTMLV2(test)
@@ -47,6 +54,20 @@ func TestReverseV2(t *testing.T) {
 	}
 }
 
+func TestReverseV2Pipes(t *testing.T) {
+	// Pipes are only escaped where they could start or close a spoiler.
+	for in, out := range map[string]string{
+		`<span class="tg-spoiler">||</span>a`: "||||||a",
+		"a | b":                               "a | b",
+		"a || b":                              `a \|\| b`,
+		`a|<span class="tg-spoiler">b</span>`: `a\|||b||`,
+	} {
+		got, err := tg_md2html.ReverseV2(in, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, out, got)
+	}
+}
+
 func TestReverseV2Buttons(t *testing.T) {
 	for _, x := range md2HTMLV2Buttons {
 		t.Run(x.in, func(t *testing.T) {
@@ -95,6 +116,10 @@ func TestReverseV2Buttons_errors(t *testing.T) {
 			name:    "invalid button style",
 			in:      "[test](buttonurl#green://blah)",
 			wantErr: tg_md2html.ErrInvalidButtonStyle,
+		}, {
+			name:    "callback data too long",
+			in:      "[test](buttoncb:" + strings.Repeat("a", 65) + ")",
+			wantErr: tg_md2html.ErrInvalidButton,
 		},
 	} {
 		t.Run(x.name, func(t *testing.T) {
@@ -109,3 +134,129 @@ func TestReverseV2Buttons_errors(t *testing.T) {
 		})
 	}
 }
+
+func TestReverseEntitiesV2(t *testing.T) {
+	var inputs []string
+	for _, x := range append(append(basicMD, basicMDv2...), advancedMD...) {
+		inputs = append(inputs, x.in)
+	}
+	inputs = append(inputs, reverseTest...)
+
+	for _, in := range inputs {
+		t.Run(in, func(t *testing.T) {
+			// Reversing entities should give the same markdown as reversing the equivalent HTML.
+			text, entities := tg_md2html.MD2EntitiesV2(in)
+			out, err := tg_md2html.ReverseEntitiesV2(text, entities, nil)
+			assert.NoError(t, err)
+
+			htmlOut, err := tg_md2html.ReverseV2(tg_md2html.MD2HTMLV2(in), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, htmlOut, out)
+		})
+	}
+}
+
+func TestReverseEntitiesV2EmptyEntities(t *testing.T) {
+	// Empty entities can't be sent as entities, so they are dropped; Reverse keeps them.
+	for _, x := range []struct {
+		in          string
+		htmlOut     string
+		entitiesOut string
+	}{
+		{in: "[](tg://user?id=7) x", htmlOut: "[](tg://user?id=7) x", entitiesOut: "x"},
+		{in: "a ``````", htmlOut: "a ``````", entitiesOut: "a"},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			out, err := tg_md2html.ReverseV2(tg_md2html.MD2HTMLV2(x.in), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.htmlOut, out)
+
+			text, entities := tg_md2html.MD2EntitiesV2(x.in)
+			assert.Empty(t, entities)
+			out, err = tg_md2html.ReverseEntitiesV2(text, entities, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.entitiesOut, out)
+		})
+	}
+}
+
+func TestReverseEntitiesV2Overlapping(t *testing.T) {
+	for _, x := range []struct {
+		name     string
+		text     string
+		entities []tg_md2html.MessageEntity
+		out      string
+	}{
+		{
+			name: "nested",
+			text: "bold italic",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityItalic, Offset: 5, Length: 6},
+				{Type: tg_md2html.EntityBold, Offset: 0, Length: 11},
+			},
+			out: "*bold _italic_*",
+		}, {
+			name: "overlapping",
+			text: "bold both italic",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityBold, Offset: 0, Length: 9},
+				{Type: tg_md2html.EntityItalic, Offset: 5, Length: 11},
+			},
+			out: "*bold _both_*_ italic_",
+		}, {
+			name: "utf16 offsets",
+			text: "👍 bold",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityBold, Offset: 3, Length: 4},
+			},
+			out: "👍 *bold*",
+		}, {
+			name: "text mention",
+			text: "hello user",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityTextMention, Offset: 6, Length: 4, User: &tg_md2html.User{ID: 1234}},
+			},
+			out: "hello [user](tg://user?id=1234)",
+		}, {
+			name: "custom emoji and date time",
+			text: "👍 at 22:45",
+			entities: []tg_md2html.MessageEntity{
+				{Type: tg_md2html.EntityCustomEmoji, Offset: 0, Length: 2, CustomEmojiID: "5368324170671202286"},
+				{Type: tg_md2html.EntityDateTime, Offset: 6, Length: 5, UnixTime: 1647531900, DateTimeFormat: "wDT"},
+			},
+			out: "![👍](tg://emoji?id=5368324170671202286) at ![22:45](tg://time?unix=1647531900&format=wDT)",
+		}, {
+			name: "ignores non-formatting entities",
+			text: "/start #tag",
+			entities: []tg_md2html.MessageEntity{
+				{Type: "bot_command", Offset: 0, Length: 6},
+				{Type: "hashtag", Offset: 7, Length: 4},
+			},
+			out: "/start #tag",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			out, err := tg_md2html.ReverseEntitiesV2(x.text, x.entities, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, out)
+		})
+	}
+}
+
+func TestReverseEntitiesV2Buttons(t *testing.T) {
+	out, err := tg_md2html.ReverseEntitiesV2("text", nil, []tg_md2html.ButtonV2{{Name: "hello", Type: "url", Content: "example.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "text\n[hello](buttonurl://example.com)", out)
+
+	_, err = tg_md2html.ReverseEntitiesV2("text", nil, []tg_md2html.ButtonV2{{Name: "hello", Type: "url"}})
+	assert.ErrorIs(t, err, tg_md2html.ErrNoButtonContent)
+}
+
+func TestReverseEntitiesV2_errors(t *testing.T) {
+	_, err := tg_md2html.ReverseEntitiesV2("text", []tg_md2html.MessageEntity{{Type: tg_md2html.EntityBold, Offset: 2, Length: 5}}, nil)
+	assert.Error(t, err)
+
+	// Offset in the middle of a surrogate pair.
+	_, err = tg_md2html.ReverseEntitiesV2("👍", []tg_md2html.MessageEntity{{Type: tg_md2html.EntityBold, Offset: 1, Length: 1}}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// MaxMessageLength is the maximum length of a telegram message, in UTF-16 code units, after entities are parsed.
+const MaxMessageLength = 4096
+
+var ErrCannotSplit = errors.New("cannot split message")
+
+// FormattedText is some plain text, and the entities which apply to it.
+type FormattedText struct {
+	Text     string
+	Entities []MessageEntity
+}
+
+func SplitHTMLV2(in string, limit int) ([]string, error) {
+	return defaultConverterV2.SplitHTML(in, limit)
+}
+
+// SplitHTML splits telegram HTML, such as the output of MD2HTML, into chunks whose visible text is at most limit
+// UTF-16 code units long. Any tags open at a split point are closed, and reopened in the following chunk.
+// See SplitEntities for how split points are chosen.
+func (cv ConverterV2) SplitHTML(in string, limit int) ([]string, error) {
+	text, entities, err := cv.HTML2Entities(in)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := SplitEntities(text, entities, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(chunks))
+	for _, c := range chunks {
+		doc, err := cv.ParseEntities(c.Text, c.Entities)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cv.Render(doc))
+	}
+	return out, nil
+}
+
+// SplitEntities splits text and its entities into chunks of at most limit UTF-16 code units.
+// Entities crossing a split point are split into one entity per chunk.
+//
+// Split points are chosen as late as possible, preferring paragraph breaks, then line breaks, then spaces. If no such
+// break is available, the text is split at the limit. Text is never split inside a custom emoji or a date_time
+// entity. Whitespace surrounding a split point is removed, except inside code and pre entities, where only the space or
+// line break which the text is split at is removed, so that indentation is kept.
+func SplitEntities(text string, entities []MessageEntity, limit int) ([]FormattedText, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: invalid limit %d", ErrCannotSplit, limit)
+	}
+
+	runes := []rune(text)
+	spans, err := getEntitySpans(runes, entities)
+	if err != nil {
+		return nil, err
+	}
+	offsets := utf16Offsets(runes)
+
+	// atomic[i] is true when the text cannot be split before rune i, and verbatim[i] when rune i is inside code, so
+	// must not be trimmed.
+	atomic := make([]bool, len(runes)+1)
+	verbatim := make([]bool, len(runes))
+	for _, s := range spans {
+		switch s.entity.Type {
+		case EntityCustomEmoji, EntityDateTime:
+			for i := s.start + 1; i < s.end; i++ {
+				atomic[i] = true
+			}
+		case EntityCode, EntityPre:
+			for i := s.start; i < s.end; i++ {
+				verbatim[i] = true
+			}
+		}
+	}
+	trimmable := func(i int) bool {
+		return unicode.IsSpace(runes[i]) && !verbatim[i]
+	}
+
+	var chunks []FormattedText
+	start := 0
+	for offsets[len(runes)]-offsets[start] > limit {
+		// Find the furthest point that fits in the limit.
+		end := start
+		for end < len(runes) && offsets[end+1]-offsets[start] <= limit {
+			end++
+		}
+
+		split := findSplit(runes, atomic, start, end)
+		if split <= start {
+			return nil, fmt.Errorf("%w: no valid split point within %d characters of offset %d", ErrCannotSplit, limit, offsets[start])
+		}
+
+		chunkEnd := split
+		for chunkEnd > start && trimmable(chunkEnd-1) {
+			chunkEnd--
+		}
+		if chunkEnd > start {
+			chunks = append(chunks, newChunk(runes, spans, offsets, start, chunkEnd))
+		}
+
+		start = split
+		if unicode.IsSpace(runes[start]) {
+			// The break itself is always removed.
+			start++
+		}
+		for start < len(runes) && trimmable(start) {
+			start++
+		}
+	}
+	if start < len(runes) {
+		chunks = append(chunks, newChunk(runes, spans, offsets, start, len(runes)))
+	}
+
+	return chunks, nil
+}
+
+// findSplit finds the best place to split the text, such that runes[start:split] is the chunk to send.
+func findSplit(runes []rune, atomic []bool, start int, end int) int {
+	if end == len(runes) {
+		return end
+	}
+
+	for _, isBreak := range []func(i int) bool{
+		func(i int) bool { return runes[i] == '\n' && i+1 < len(runes) && runes[i+1] == '\n' }, // paragraphs
+		func(i int) bool { return runes[i] == '\n' },                                           // lines
+		func(i int) bool { return unicode.IsSpace(runes[i]) },                                  // words
+	} {
+		for i := end; i > start; i-- {
+			if isBreak(i) && !atomic[i] {
+				return i
+			}
+		}
+	}
+
+	// No good breaks; split as late as possible.
+	for i := end; i > start; i-- {
+		if !atomic[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+func newChunk(runes []rune, spans []entitySpan, offsets []int, start int, end int) FormattedText {
+	var entities []MessageEntity
+	for _, s := range spans {
+		eStart, eEnd := max(s.start, start), min(s.end, end)
+		if eStart >= eEnd {
+			continue
+		}
+
+		e := s.entity
+		e.Offset = offsets[eStart] - offsets[start]
+		e.Length = offsets[eEnd] - offsets[eStart]
+		entities = append(entities, e)
+	}
+
+	return FormattedText{
+		Text:     string(runes[start:end]),
+		Entities: entities,
+	}
+}
@@ -0,0 +1,122 @@
+package tg_md2html_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestSplitHTMLV2(t *testing.T) {
+	for _, x := range []struct {
+		name  string
+		in    string
+		limit int
+		out   []string
+	}{
+		{
+			name:  "fits",
+			in:    "<b>short</b>",
+			limit: 10,
+			out:   []string{"<b>short</b>"},
+		}, {
+			name:  "prefers paragraphs",
+			in:    "first para\n\nsecond line\nthird line",
+			limit: 30,
+			out:   []string{"first para", "second line\nthird line"},
+		}, {
+			name:  "then lines",
+			in:    "first line\nsecond line",
+			limit: 15,
+			out:   []string{"first line", "second line"},
+		}, {
+			name:  "then words",
+			in:    "some words here",
+			limit: 11,
+			out:   []string{"some words", "here"},
+		}, {
+			name:  "then anywhere",
+			in:    "abcdefghij",
+			limit: 4,
+			out:   []string{"abcd", "efgh", "ij"},
+		}, {
+			name:  "reopens tags",
+			in:    `<b>bold <span class="tg-spoiler">spoiler text</span></b>`,
+			limit: 13,
+			out:   []string{`<b>bold <span class="tg-spoiler">spoiler</span></b>`, `<b><span class="tg-spoiler">text</span></b>`},
+		}, {
+			name:  "reopens pre with language",
+			in:    "<pre><code class=\"language-go\">line one\nline two</code></pre>",
+			limit: 10,
+			out:   []string{"<pre><code class=\"language-go\">line one</code></pre>", "<pre><code class=\"language-go\">line two</code></pre>"},
+		}, {
+			name:  "keeps indentation in pre",
+			in:    "<pre>func f() {\n    return 1\n}</pre>",
+			limit: 14,
+			out:   []string{"<pre>func f() {</pre>", "<pre>    return 1\n}</pre>"},
+		}, {
+			name:  "reopens blockquotes",
+			in:    "<blockquote expandable>line one\nline two</blockquote>",
+			limit: 10,
+			out:   []string{"<blockquote expandable>line one</blockquote>", "<blockquote expandable>line two</blockquote>"},
+		}, {
+			name:  "counts visible text only",
+			in:    "a &amp; b &amp; c",
+			limit: 5,
+			out:   []string{"a &amp; b", "&amp; c"},
+		}, {
+			name:  "does not split custom emoji",
+			in:    `ab<tg-emoji emoji-id="5368324170671202286">👍👍</tg-emoji>`,
+			limit: 4,
+			out:   []string{"ab", `<tg-emoji emoji-id="5368324170671202286">👍👍</tg-emoji>`},
+		}, {
+			name:  "does not split time",
+			in:    `at <tg-time unix="1647531900">22:45</tg-time>`,
+			limit: 6,
+			out:   []string{"at", `<tg-time unix="1647531900">22:45</tg-time>`},
+		}, {
+			name:  "does not split surrogate pairs",
+			in:    "👍👍👍",
+			limit: 3,
+			out:   []string{"👍", "👍", "👍"},
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			out, err := tg_md2html.SplitHTMLV2(x.in, x.limit)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, out)
+		})
+	}
+}
+
+func TestSplitHTMLV2_errors(t *testing.T) {
+	_, err := tg_md2html.SplitHTMLV2(`<tg-emoji emoji-id="5368324170671202286">👍👍</tg-emoji>`, 2)
+	assert.ErrorIs(t, err, tg_md2html.ErrCannotSplit)
+
+	_, err = tg_md2html.SplitHTMLV2("text", 0)
+	assert.ErrorIs(t, err, tg_md2html.ErrCannotSplit)
+
+	_, err = tg_md2html.SplitHTMLV2("<b>text", 10)
+	assert.Error(t, err)
+}
+
+func TestSplitEntities(t *testing.T) {
+	text, entities := tg_md2html.MD2EntitiesV2(strings.Repeat("*bold* word ", 1000))
+	chunks, err := tg_md2html.SplitEntities(text, entities, tg_md2html.MaxMessageLength)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3)
+
+	var total int
+	for _, c := range chunks {
+		assert.LessOrEqual(t, len(c.Text), tg_md2html.MaxMessageLength)
+		assert.Equal(t, strings.TrimSpace(c.Text), c.Text)
+		for _, e := range c.Entities {
+			assert.Equal(t, "bold", c.Text[e.Offset:e.Offset+e.Length])
+		}
+		total += len(c.Entities)
+	}
+	// Splits happen on spaces, so no bold entities were split.
+	assert.Equal(t, 1000, total)
+}
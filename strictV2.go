@@ -0,0 +1,198 @@
+package tg_md2html
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiagnosticKind is the kind of problem a Diagnostic describes.
+type DiagnosticKind string
+
+const (
+	// DiagnosticUnclosedDelimiter is reported when an opening delimiter (eg "*", "||", "[") has no valid closing one.
+	DiagnosticUnclosedDelimiter DiagnosticKind = "unclosed_delimiter"
+	// DiagnosticEmptyEntity is reported when an entity, link or button has no contents.
+	DiagnosticEmptyEntity DiagnosticKind = "empty_entity"
+	// DiagnosticBadEmojiID is reported when a custom emoji has a missing or invalid id.
+	DiagnosticBadEmojiID DiagnosticKind = "bad_emoji_id"
+	// DiagnosticBadTimeQuery is reported when a time has a missing or invalid unix time or format.
+	DiagnosticBadTimeQuery DiagnosticKind = "bad_time_query"
+	// DiagnosticBadSpecialLink is reported when one of the converter's LinkHandlers rejects a link's URL.
+	DiagnosticBadSpecialLink DiagnosticKind = "bad_special_link"
+	// DiagnosticRejectedLink is reported when a link or url button is rejected by the converter's LinkPolicy. It is
+	// kept as text.
+	DiagnosticRejectedLink DiagnosticKind = "rejected_link"
+	// DiagnosticBadUserID is reported when a tg://user mention has a missing or invalid user id. It is kept as a
+	// regular link.
+	DiagnosticBadUserID DiagnosticKind = "bad_user_id"
+	// DiagnosticBadButtonStyle is reported when a button uses a style not known by the converter.
+	DiagnosticBadButtonStyle DiagnosticKind = "bad_button_style"
+	// DiagnosticInvalidButton is reported when a button's content isn't valid for its type; see ButtonV2.Validate.
+	DiagnosticInvalidButton DiagnosticKind = "invalid_button"
+	// DiagnosticDisallowedEntity is reported when an entity isn't in the converter's AllowedEntities.
+	DiagnosticDisallowedEntity DiagnosticKind = "disallowed_entity"
+	// DiagnosticInvalidNesting is reported when an entity is nested inside one that telegram doesn't allow it in.
+	// The inner entity is flattened in the output.
+	DiagnosticInvalidNesting DiagnosticKind = "invalid_nesting"
+)
+
+// Diagnostic describes a problem found while parsing markdown.
+type Diagnostic struct {
+	// Offset of the problem in the input, in runes.
+	Offset int
+	// Line and Column of the problem in the input, starting from 1. Columns are counted in runes.
+	Line   int
+	Column int
+	Kind   DiagnosticKind
+	// Message is a human-readable explanation of the problem.
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+func MD2HTMLStrictV2(in string) (string, []Diagnostic, error) {
+	return defaultConverterV2.MD2HTMLStrict(in)
+}
+
+func MD2HTMLButtonsStrictV2(in string) (string, []ButtonV2, []Diagnostic, error) {
+	return defaultConverterV2.MD2HTMLButtonsStrict(in)
+}
+
+// MD2HTMLStrict converts markdown to HTML like MD2HTML, and also returns a list of problems found in the input, ordered
+// by offset. The HTML output is always the same as MD2HTML.
+// If the input goes over the converter's Limits, a *LimitError is returned instead.
+func (cv ConverterV2) MD2HTMLStrict(in string) (string, []Diagnostic, error) {
+	doc, diags, err := cv.parseDiagnostics(in, false)
+	if err != nil {
+		return "", nil, err
+	}
+	return cv.Render(doc), diags, nil
+}
+
+// MD2HTMLButtonsStrict converts markdown to HTML and buttons like MD2HTMLButtons, and also returns a list of problems
+// found in the input, ordered by offset.
+// If the input goes over the converter's Limits, a *LimitError is returned instead.
+func (cv ConverterV2) MD2HTMLButtonsStrict(in string) (string, []ButtonV2, []Diagnostic, error) {
+	doc, diags, err := cv.parseDiagnostics(in, true)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return cv.Render(doc), doc.Buttons(), diags, nil
+}
+
+// parserV2 holds the state for a single markdown parse.
+type parserV2 struct {
+	cv            ConverterV2
+	delims        *delimiterSet
+	enableButtons bool
+	diagnostics   []Diagnostic
+	// stack holds the frames currently being parsed, outermost first.
+	stack []*parseFrame
+
+	// err is set when the parse goes over one of the converter's Limits.
+	err      error
+	work     int
+	entities int
+
+	// directives maps the escaped name of each directive to the directive, when buttons are enabled.
+	directives      map[string]Directive
+	maxDirectiveLen int
+
+	// codeRanges holds the input offsets covered by each code and pre entity, when recordCode is set.
+	recordCode bool
+	codeRanges [][2]int
+}
+
+func (p *parserV2) addDiagnostic(offset int, kind DiagnosticKind, format string, args ...any) {
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Offset:  offset,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// addButtonDiagnostics reports any problems with a parsed button.
+func (p *parserV2) addButtonDiagnostics(offset int, btn ButtonV2) {
+	if btn.Name == "" || (btn.Content == "" && buttonNeedsContent(btn.Type)) {
+		p.addDiagnostic(offset, DiagnosticEmptyEntity, "button is missing a name or content")
+	}
+	if _, ok := p.cv.Styles[btn.Style]; btn.Style != "" && !ok {
+		p.addDiagnostic(offset, DiagnosticBadButtonStyle, "unknown button style %q", btn.Style)
+	}
+	if btn.Err != nil {
+		p.addDiagnostic(offset, DiagnosticInvalidButton, "%s", btn.Err)
+	}
+}
+
+// getDiagnostics sorts the diagnostics, and fills in the line and column of each one.
+func (p *parserV2) getDiagnostics(in []rune) []Diagnostic {
+	sort.SliceStable(p.diagnostics, func(i, j int) bool {
+		return p.diagnostics[i].Offset < p.diagnostics[j].Offset
+	})
+
+	line, col, idx := 1, 1, 0
+	for i := range p.diagnostics {
+		for ; idx < p.diagnostics[i].Offset && idx < len(in); idx++ {
+			if in[idx] == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		p.diagnostics[i].Line = line
+		p.diagnostics[i].Column = col
+	}
+	return p.diagnostics
+}
+
+// escapeHTML escapes the input in the same way as html.EscapeString, and also returns the offset in the input of each
+// escaped rune.
+func escapeHTML(in string) ([]rune, []int) {
+	runes := make([]rune, 0, len(in))
+	pos := make([]int, 0, len(in))
+	idx := 0
+	for _, r := range in {
+		var s string
+		switch r {
+		case '&':
+			s = "&amp;"
+		case '\'':
+			s = "&#39;"
+		case '<':
+			s = "&lt;"
+		case '>':
+			s = "&gt;"
+		case '"':
+			s = "&#34;"
+		default:
+			runes = append(runes, r)
+			pos = append(pos, idx)
+			idx++
+			continue
+		}
+		for _, c := range s {
+			runes = append(runes, c)
+			pos = append(pos, idx)
+		}
+		idx++
+	}
+	return runes, pos
+}
+
+// validTimeFormat checks whether the format is one telegram accepts: either "r" for relative times, or an optional
+// "w" (weekday), followed by an optional "d" or "D" (date), and an optional "t" or "T" (time).
+func validTimeFormat(format string) bool {
+	if format == "r" {
+		return true
+	}
+	for _, allowed := range []string{"w", "dD", "tT"} {
+		if format != "" && strings.ContainsRune(allowed, rune(format[0])) {
+			format = format[1:]
+		}
+	}
+	return format == ""
+}
@@ -0,0 +1,136 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestMD2HTMLStrictV2(t *testing.T) {
+	for _, x := range []struct {
+		in    string
+		out   string
+		diags []tg_md2html.Diagnostic
+	}{
+		{
+			in:  "*unclosed",
+			out: "*unclosed",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticUnclosedDelimiter, Message: `unclosed "*"`},
+			},
+		}, {
+			in:  "hello\n||world",
+			out: "hello\n||world",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 6, Line: 2, Column: 1, Kind: tg_md2html.DiagnosticUnclosedDelimiter, Message: `unclosed "||"`},
+			},
+		}, {
+			// Offsets count runes in the input, not in the escaped HTML.
+			in:  "it's \"<*b*\" & *b _i*",
+			out: "it&#39;s &#34;&lt;<b>b</b>&#34; &amp; <b>b _i</b>",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 17, Line: 1, Column: 18, Kind: tg_md2html.DiagnosticUnclosedDelimiter, Message: `unclosed "_"`},
+			},
+		}, {
+			in:  "[link](example.com",
+			out: "[link](example.com",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticUnclosedDelimiter, Message: "unclosed link"},
+			},
+		}, {
+			in:  "[](example.com)",
+			out: `<a href="example.com"></a>`,
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticEmptyEntity, Message: "empty link text"},
+			},
+		}, {
+			in:  "[user](tg://user?id=me)",
+			out: `<a href="tg://user?id=me">user</a>`,
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticBadUserID, Message: `invalid mention: user id "me" is not a number`},
+			},
+		}, {
+			in:  "![👍](tg://emoji?foo=1)",
+			out: "![👍](tg://emoji?foo=1)",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticBadEmojiID, Message: "missing emoji id"},
+			},
+		}, {
+			in:  "![👍](tg://emoji?id=abc)",
+			out: `<tg-emoji emoji-id="abc">👍</tg-emoji>`,
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticBadEmojiID, Message: `emoji id "abc" is not a number`},
+			},
+		}, {
+			in:  "![22:45](tg://time?unix=tomorrow)",
+			out: "![22:45](tg://time?unix=tomorrow)",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticBadTimeQuery, Message: `invalid unix time "tomorrow"`},
+			},
+		}, {
+			in:  "![22:45](tg://time?unix=1647531900&format=q)",
+			out: `<tg-time unix="1647531900" format="q">22:45</tg-time>`,
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 0, Line: 1, Column: 1, Kind: tg_md2html.DiagnosticBadTimeQuery, Message: `invalid time format "q"`},
+			},
+		}, {
+			in:  ">quote\n>*bold",
+			out: "<blockquote>quote\n*bold</blockquote>",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 8, Line: 2, Column: 2, Kind: tg_md2html.DiagnosticUnclosedDelimiter, Message: `unclosed "*"`},
+			},
+		}, {
+			in:  "*bold `code`*",
+			out: "<b>bold code</b>",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 6, Line: 1, Column: 7, Kind: tg_md2html.DiagnosticInvalidNesting, Message: "code cannot be nested inside bold"},
+			},
+		}, {
+			in:  "[*bold ![👍](tg://emoji?id=5368324170671202286)*](example.com)",
+			out: `<a href="example.com"><b>bold 👍</b></a>`,
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 7, Line: 1, Column: 8, Kind: tg_md2html.DiagnosticInvalidNesting, Message: "custom_emoji cannot be nested inside text_link"},
+			},
+		}, {
+			in:  ">quote\n>>nested",
+			out: "<blockquote>quote\nnested</blockquote>",
+			diags: []tg_md2html.Diagnostic{
+				{Offset: 8, Line: 2, Column: 2, Kind: tg_md2html.DiagnosticInvalidNesting, Message: "blockquote cannot be nested inside blockquote"},
+			},
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			out, diags, err := tg_md2html.MD2HTMLStrictV2(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, x.out, out)
+			assert.Equal(t, x.diags, diags)
+		})
+	}
+}
+
+func TestMD2HTMLStrictV2_valid(t *testing.T) {
+	for _, x := range basicMDv2 {
+		t.Run(x.in, func(t *testing.T) {
+			out, diags, err := tg_md2html.MD2HTMLStrictV2(x.in)
+			assert.NoError(t, err)
+			assert.Equal(t, tg_md2html.MD2HTMLV2(x.in), out)
+			assert.Empty(t, diags)
+		})
+	}
+}
+
+func TestMD2HTMLButtonsStrictV2(t *testing.T) {
+	out, btns, diags, err := tg_md2html.MD2HTMLButtonsStrictV2("text\n[btn](buttonurl#blue://example.com)\n[](buttonurl://example.com)")
+	assert.NoError(t, err)
+	assert.Equal(t, "text", out)
+	assert.Equal(t, []tg_md2html.ButtonV2{
+		{Name: "btn", Type: "url", Content: "example.com", Style: "blue"},
+		{Name: "", Type: "url", Content: "example.com"},
+	}, btns)
+	assert.Equal(t, []tg_md2html.Diagnostic{
+		{Offset: 5, Line: 2, Column: 1, Kind: tg_md2html.DiagnosticBadButtonStyle, Message: `unknown button style "blue"`},
+		{Offset: 41, Line: 3, Column: 1, Kind: tg_md2html.DiagnosticEmptyEntity, Message: "button is missing a name or content"},
+	}, diags)
+}
@@ -0,0 +1,142 @@
+package tg_md2html
+
+import (
+	"strings"
+)
+
+func ToTelegramMarkdownV2(in string) string {
+	return defaultConverterV2.ToTelegramMarkdownV2(in)
+}
+
+// ToTelegramMarkdownV2 converts markdown, as accepted by MD2HTML, into telegram's own MarkdownV2 dialect, to be sent with
+// parse_mode=MarkdownV2. Telegram renders the output the same as the HTML returned by MD2HTML.
+func (cv ConverterV2) ToTelegramMarkdownV2(in string) string {
+	return cv.RenderTelegramMarkdownV2(cv.parse(in, false))
+}
+
+// RenderTelegramMarkdownV2 converts a parsed Document to telegram's MarkdownV2 dialect.
+// Buttons aren't part of the text, so they are skipped.
+//
+// Telegram only supports blockquotes at the start of a line, and ending at the end of a line; if the document has a
+// blockquote elsewhere, a newline is added before or after it.
+func (cv ConverterV2) RenderTelegramMarkdownV2(doc *Document) string {
+	w := tgMarkdownWriter{}
+	w.writeNodes(doc.Nodes)
+	return w.out.String()
+}
+
+// telegramMarkdownV2Chars are the characters which telegram requires to be escaped outside of code, pre and link URLs.
+// https://core.telegram.org/bots/api#markdownv2-style
+const telegramMarkdownV2Chars = "\\_*[]()~`>#+-=|{}.!"
+
+type tgMarkdownWriter struct {
+	out strings.Builder
+	// lastDelim is the last character of the last delimiter, if nothing else has been written since.
+	lastDelim byte
+	// afterQuote is set when a blockquote has just ended, and only newlines have been written since.
+	afterQuote bool
+}
+
+func (w *tgMarkdownWriter) writeNodes(nodes []Node) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *Text:
+			w.write(escapeTelegram(n.Value, telegramMarkdownV2Chars))
+		case *Bold:
+			w.writeEntity("*", n.Children, "*")
+		case *Italic:
+			w.writeEntity("_", n.Children, "_")
+		case *Underline:
+			w.writeEntity("__", n.Children, "__")
+		case *Strike:
+			w.writeEntity("~", n.Children, "~")
+		case *Spoiler:
+			w.writeEntity("||", n.Children, "||")
+		case *Code:
+			w.writeDelim("`")
+			w.write(escapeTelegram(n.Value, "\\`"))
+			w.writeDelim("`")
+		case *Pre:
+			// The language is always followed by a newline, so that the first line of code is never taken as the language.
+			w.writeDelim("```")
+			w.write(escapeTelegram(n.Language, "\\`") + "\n" + escapeTelegram(n.Value, "\\`"))
+			w.writeDelim("```")
+		case *Link:
+			w.writeEntity("[", n.Children, "]("+escapeTelegram(n.URL, "\\)")+")")
+		case *Mention:
+			w.writeEntity("[", n.Children, "]("+mentionURL(n.UserID)+")")
+		case *CustomEmoji, *Time, *SpecialLink:
+			h, data, nested := specialLink(n)
+			w.writeEntity("![", nested, "]("+escapeTelegram(h.URL(data), "\\)")+")")
+		case *Blockquote:
+			w.writeBlockquote(n)
+		case *ButtonNode, *ReplyButtonNode, *ReplyKeyboardNode, *DirectiveNode:
+			// Buttons and directives are sent separately; they aren't part of the text.
+		}
+	}
+}
+
+func (w *tgMarkdownWriter) writeEntity(open string, nodes []Node, closing string) {
+	w.writeDelim(open)
+	w.writeNodes(nodes)
+	w.writeDelim(closing)
+}
+
+// writeDelim writes an entity delimiter. When the previous delimiter ends with the same character (eg "_" and "__"),
+// a '\r' is written between them; telegram ignores it, but it stops the two delimiters being read as one.
+func (w *tgMarkdownWriter) writeDelim(d string) {
+	if w.lastDelim != 0 && w.lastDelim == d[0] {
+		w.write("\r")
+	}
+	w.write(d)
+	w.lastDelim = d[len(d)-1]
+}
+
+func (w *tgMarkdownWriter) write(s string) {
+	if s == "" {
+		return
+	}
+	if w.afterQuote {
+		if s[0] != '\n' {
+			// Anything following a blockquote on the same line would be part of it.
+			w.out.WriteByte('\n')
+		}
+		w.afterQuote = strings.Trim(s, "\n") == ""
+	}
+	w.out.WriteString(s)
+	w.lastDelim = 0
+}
+
+func (w *tgMarkdownWriter) writeBlockquote(n *Blockquote) {
+	prefix := ">"
+	if w.afterQuote || n.Expandable {
+		// An empty bold entity separates the quote from the previous one; telegram would otherwise join them.
+		prefix = "**>"
+	}
+	if out := w.out.String(); out != "" && !strings.HasSuffix(out, "\n") {
+		w.write("\n")
+	}
+
+	nested := tgMarkdownWriter{}
+	nested.writeNodes(n.Children)
+	quote := prefix + strings.ReplaceAll(nested.out.String(), "\n", "\n>")
+	if n.Expandable {
+		quote += "||"
+	}
+
+	w.afterQuote = false
+	w.write(quote)
+	w.afterQuote = true
+}
+
+// escapeTelegram adds a backslash before any of the given characters.
+func escapeTelegram(s string, chars string) string {
+	out := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
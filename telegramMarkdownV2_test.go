@@ -0,0 +1,96 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestToTelegramMarkdownV2(t *testing.T) {
+	for _, x := range []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "Hello. 1+1=2! (yes) #tag {x} a-b",
+			out: `Hello\. 1\+1\=2\! \(yes\) \#tag \{x\} a\-b`,
+		}, {
+			in:  `escaped \*stars\* and \ slash`,
+			out: `escaped \*stars\* and \\ slash`,
+		}, {
+			in:  "*bold _italic_* ~strike~ ||spoiler||",
+			out: "*bold _italic_* ~strike~ ||spoiler||",
+		}, {
+			// Italic and underline delimiters are separated with \r, as telegram suggests.
+			in:  "___italic underline___",
+			out: "__\r_italic underline_\r__",
+		}, {
+			in:  "`code with a \\` and a . dot`",
+			out: "`code with a \\\\\\` and a . dot`",
+		}, {
+			in:  "```go\nfmt.Println(`hi`)```",
+			out: "```go\nfmt.Println(\\`hi\\`)```",
+		}, {
+			in:  "```no language```",
+			out: "```\nno language```",
+		}, {
+			in:  "[a *link*.](example.com/a_b?c=(d\\))",
+			out: `[a *link*\.](example.com/a_b?c=(d\\\))`,
+		}, {
+			in:  "![👍](tg://emoji?id=5368324170671202286) at ![22:45](tg://time?unix=1647531900&format=wDT)",
+			out: "![👍](tg://emoji?id=5368324170671202286) at ![22:45](tg://time?unix=1647531900&format=wDT)",
+		}, {
+			in:  ">quote with a . dot\n>second line\nafter",
+			out: ">quote with a \\. dot\n>second line\nafter",
+		}, {
+			in:  ">quote\n**>expandable\n>quote||",
+			out: ">quote\n**>expandable\n>quote||",
+		}, {
+			in:  "[button](buttonurl://example.com)",
+			out: "[button](buttonurl://example.com)",
+		},
+	} {
+		t.Run(x.in, func(t *testing.T) {
+			assert.Equal(t, x.out, tg_md2html.ToTelegramMarkdownV2(x.in))
+		})
+	}
+}
+
+func TestRenderTelegramMarkdownV2(t *testing.T) {
+	for _, x := range []struct {
+		name string
+		doc  *tg_md2html.Document
+		out  string
+	}{
+		{
+			name: "quote not at start of line",
+			doc: &tg_md2html.Document{Nodes: []tg_md2html.Node{
+				&tg_md2html.Text{Value: "text"},
+				&tg_md2html.Blockquote{Children: []tg_md2html.Node{&tg_md2html.Text{Value: "quote"}}},
+				&tg_md2html.Text{Value: "more"},
+			}},
+			out: "text\n>quote\nmore",
+		}, {
+			name: "adjacent quotes",
+			doc: &tg_md2html.Document{Nodes: []tg_md2html.Node{
+				&tg_md2html.Blockquote{Children: []tg_md2html.Node{&tg_md2html.Text{Value: "first"}}},
+				&tg_md2html.Text{Value: "\n"},
+				&tg_md2html.Blockquote{Children: []tg_md2html.Node{&tg_md2html.Text{Value: "second"}}},
+			}},
+			out: ">first\n**>second",
+		}, {
+			name: "buttons are skipped",
+			doc: &tg_md2html.Document{Nodes: []tg_md2html.Node{
+				&tg_md2html.Text{Value: "text"},
+				&tg_md2html.ButtonNode{ButtonV2: tg_md2html.ButtonV2{Name: "btn", Type: "url", Content: "example.com"}},
+			}},
+			out: "text",
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			assert.Equal(t, x.out, testConverter().RenderTelegramMarkdownV2(x.doc))
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package tg_md2html
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Filling is a value substituted into a template by FillTemplate.
+type Filling struct {
+	// Text is the plain text of the filling. It is escaped for wherever it lands in the template.
+	Text string
+	// URL, if set, links the text when the filling is used in normal text; eg a tg://user?id= mention.
+	URL string
+}
+
+// MentionFilling returns a filling which mentions a user by their ID.
+func MentionFilling(userID int64, name string) Filling {
+	return Filling{Text: name, URL: mentionURL(userID)}
+}
+
+// templateContext is the part of the markdown a filling lands in, which determines how it is escaped.
+type templateContext int
+
+const (
+	contextText templateContext = iota
+	contextURL
+	contextCode
+	contextPre
+)
+
+var ErrInvalidFilling = errors.New("invalid filling")
+
+// templateHole is a filling, or an escaped \{ brace, found in a template, along with the template text before it.
+type templateHole struct {
+	text  string
+	name  string
+	brace bool
+}
+
+// Template placeholders are made of private use runes, which are never markdown, so that they land in the same place as
+// the fillings they replace.
+const (
+	templatePlaceholderStart = '\uE000'
+	templatePlaceholderEnd   = '\uE001'
+)
+
+func templatePlaceholder(idx int) string {
+	return string(templatePlaceholderStart) + strconv.Itoa(idx) + string(templatePlaceholderEnd)
+}
+
+// holeContext is where a template placeholder landed; linkText is set inside the text of a link, where fillings can't
+// be links themselves.
+type holeContext struct {
+	ctx      templateContext
+	linkText bool
+}
+
+// templateContexts maps the index of each template placeholder to where it landed in the parsed template.
+type templateContexts map[int]holeContext
+
+// walk finds the placeholders in the nodes.
+func (c templateContexts) walk(nodes []Node, linkText bool) {
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *Text:
+			c.add(n.Value, contextText, linkText)
+		case *Code:
+			c.add(n.Value, contextCode, linkText)
+		case *Pre:
+			c.add(n.Value, contextPre, linkText)
+		case *Link:
+			c.add(n.URL, contextURL, linkText)
+			c.walk(n.Children, true)
+		case *ButtonNode:
+			c.add(n.Name, contextText, true)
+			c.add(n.Content, contextURL, true)
+		case *ReplyButtonNode:
+			c.add(n.Name, contextText, true)
+			c.add(n.Content, contextURL, true)
+		case *ReplyKeyboardNode:
+			c.add(n.Placeholder, contextText, true)
+		case *Mention, *CustomEmoji, *Time, *SpecialLink:
+			c.walk(children(n), true)
+		default:
+			c.walk(children(n), linkText)
+		}
+	}
+}
+
+// add records the context of the placeholders in s.
+func (c templateContexts) add(s string, ctx templateContext, linkText bool) {
+	for {
+		_, s, _ = strings.Cut(s, string(templatePlaceholderStart))
+		idx, rest, ok := strings.Cut(s, string(templatePlaceholderEnd))
+		if !ok {
+			return
+		}
+		if i, err := strconv.Atoi(idx); err == nil {
+			c[i] = holeContext{ctx: ctx, linkText: linkText}
+		}
+		s = rest
+	}
+}
+
+func FillTemplateV2(tmpl string, fillings map[string]Filling) (string, error) {
+	return defaultConverterV2.FillTemplate(tmpl, fillings)
+}
+
+// FillTemplate replaces each {name} in the markdown template with the matching filling, such as {first} or {mention}.
+// Fillings are escaped for where they land: in normal text or link text, in a link's URL, or inside code. This is found
+// by parsing the template, so user-provided values, such as names or directives, can never add formatting or break the
+// template's own formatting. Fillings which don't land in any of these are escaped as text. Unknown names, and escaped
+// \{ braces, are kept as-is.
+//
+// Code can't be escaped, so fillings inside code are written as they are. ErrInvalidFilling is returned for values
+// which would end the code early: those containing a backtick (or "```" inside pre) or ending in a backslash.
+func (cv ConverterV2) FillTemplate(tmpl string, fillings map[string]Filling) (string, error) {
+	// Replace the fillings and escaped braces with placeholders, and parse the template to find where each one lands.
+	in := []rune(tmpl)
+	var holes []templateHole
+	placeholders := strings.Builder{}
+	text := strings.Builder{}
+	addHole := func(h templateHole) {
+		h.text = text.String()
+		text.Reset()
+		placeholders.WriteString(templatePlaceholder(len(holes)))
+		holes = append(holes, h)
+	}
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if c == '\\' && i+1 < len(in) {
+			if in[i+1] == '{' {
+				addHole(templateHole{brace: true})
+			} else {
+				placeholders.WriteString(string(in[i : i+2]))
+				text.WriteString(string(in[i : i+2]))
+			}
+			i++
+			continue
+		}
+		if c == '{' {
+			if end := slices.Index(in[i+1:], '}'); end >= 0 {
+				name := string(in[i+1 : i+1+end])
+				if _, ok := fillings[name]; ok {
+					addHole(templateHole{name: name})
+					i += end + 1
+					continue
+				}
+			}
+		}
+		placeholders.WriteRune(c)
+		text.WriteRune(c)
+	}
+	contexts := templateContexts{}
+	contexts.walk(cv.parse(placeholders.String(), true).Nodes, false)
+
+	d := cv.delimiters()
+	out := strings.Builder{}
+	for idx, h := range holes {
+		out.WriteString(h.text)
+		hc, ok := contexts[idx]
+		if !ok {
+			// The placeholder didn't land anywhere we know how to escape for, so play it safe.
+			hc = holeContext{ctx: contextText, linkText: true}
+		}
+		if h.brace {
+			// Braces are only escaped in the output if they could be read as directives, which are never read inside code.
+			if d.escapable['{'] && hc.ctx != contextCode && hc.ctx != contextPre {
+				out.WriteString("\\{")
+			} else {
+				out.WriteRune('{')
+			}
+			continue
+		}
+		f := fillings[h.name]
+		s, ok := d.escapeFilling(f, hc.ctx, hc.linkText)
+		if !ok {
+			return "", fmt.Errorf("%w: {%s} can't be written inside code: %q", ErrInvalidFilling, h.name, f.Text)
+		}
+		out.WriteString(s)
+	}
+	out.WriteString(text.String())
+	return out.String(), nil
+}
+
+// escapeFilling escapes a filling for the context it lands in. It returns false if the filling can't be written there.
+func (d *delimiterSet) escapeFilling(f Filling, ctx templateContext, linkText bool) (string, bool) {
+	switch ctx {
+	case contextURL:
+		// Markdown characters which QueryEscape keeps are encoded too, in case the URL is a button's content.
+		return strings.NewReplacer("_", "%5F", "~", "%7E").Replace(url.QueryEscape(f.Text)), true
+	case contextCode:
+		return f.Text, !strings.Contains(f.Text, "`") && !strings.HasSuffix(f.Text, "\\")
+	case contextPre:
+		// Backticks at the end would join the closing delimiter.
+		return f.Text, !strings.Contains(f.Text, "```") && !strings.HasSuffix(f.Text, "`") && !strings.HasSuffix(f.Text, "\\")
+	}
+	if f.URL == "" || linkText {
+		return d.escapeReverse(f.Text), true
+	}
+	link := strings.NewReplacer(")", "%29", "\\", "%5C").Replace(f.URL)
+	return "[" + d.escapeReverse(f.Text) + "](" + link + ")", true
+}
@@ -0,0 +1,117 @@
+package tg_md2html_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	tg_md2html "github.com/PaulSonOfLars/gotg_md2html"
+)
+
+func TestFillTemplateV2(t *testing.T) {
+	fillings := map[string]tg_md2html.Filling{
+		"first":    {Text: "*_[x](y)"},
+		"username": {Text: "a b_c&d)e"},
+		"path":     {Text: `C:\ab`},
+		"keys":     {Text: "{protect}{nonotif}"},
+		"mention":  tg_md2html.MentionFilling(1234, "Ali)ce*"),
+	}
+
+	for _, x := range []struct {
+		name string
+		in   string
+		md   string
+		html string
+	}{
+		{
+			name: "text",
+			in:   "Hi {first}, welcome to *the group*!",
+			md:   `Hi \*\_\[x\]\(y\), welcome to *the group*!`,
+			html: "Hi *_[x](y), welcome to <b>the group</b>!",
+		}, {
+			name: "mention",
+			in:   "Hi {mention}!",
+			md:   `Hi [Ali\)ce\*](tg://user?id=1234)!`,
+			html: `Hi <a href="tg://user?id=1234">Ali)ce*</a>!`,
+		}, {
+			name: "mention in link text",
+			in:   "Hi [{mention}](tg://user?id=1)!",
+			md:   `Hi [Ali\)ce\*](tg://user?id=1)!`,
+			html: `Hi <a href="tg://user?id=1">Ali)ce*</a>!`,
+		}, {
+			name: "url",
+			in:   "[profile](https://example.com/?u={username}) _done_",
+			md:   "[profile](https://example.com/?u=a+b%5Fc%26d%29e) _done_",
+			html: `<a href="https://example.com/?u=a+b%5Fc%26d%29e">profile</a> <i>done</i>`,
+		}, {
+			name: "code",
+			in:   "`{path}` `\\{path}` *bold*",
+			md:   "`C:\\ab` `{path}` *bold*",
+			html: "<code>C:\\ab</code> <code>{path}</code> <b>bold</b>",
+		}, {
+			name: "pre",
+			in:   "```\n{path} {keys}```_italic_",
+			md:   "```\nC:\\ab {protect}{nonotif}```_italic_",
+			html: "<pre>C:\\ab {protect}{nonotif}</pre><i>italic</i>",
+		}, {
+			name: "literal backtick",
+			in:   "Don`t forget, {first}!",
+			md:   "Don`t forget, \\*\\_\\[x\\]\\(y\\)!",
+			html: "Don`t forget, *_[x](y)!",
+		}, {
+			name: "brackets outside a link",
+			in:   "a ]({first}) and ]( {mention} )",
+			md:   `a ](\*\_\[x\]\(y\)) and ]( [Ali\)ce\*](tg://user?id=1234) )`,
+			html: `a ](*_[x](y)) and ]( <a href="tg://user?id=1234">Ali)ce*</a> )`,
+		}, {
+			name: "directives",
+			in:   "Hi {keys}",
+			md:   "Hi {protect}{nonotif}",
+			html: "Hi {protect}{nonotif}",
+		}, {
+			name: "escaped and unknown",
+			in:   `\{first} {last}`,
+			md:   `{first} {last}`,
+			html: `{first} {last}`,
+		},
+	} {
+		t.Run(x.name, func(t *testing.T) {
+			md, err := tg_md2html.FillTemplateV2(x.in, fillings)
+			assert.NoError(t, err)
+			assert.Equal(t, x.md, md)
+			assert.Equal(t, x.html, tg_md2html.MD2HTMLV2(md))
+		})
+	}
+}
+
+func TestFillTemplateV2Directives(t *testing.T) {
+	cv := tg_md2html.NewV2(nil, nil)
+	cv.Directives = tg_md2html.DefaultDirectives()
+	fillings := map[string]tg_md2html.Filling{"first": {Text: "{protect}{nonotif}"}}
+
+	md, err := cv.FillTemplate(`Hi {first} \{first} `+"`{first}`", fillings)
+	assert.NoError(t, err)
+	assert.Equal(t, `Hi \{protect}\{nonotif} \{first} `+"`{protect}{nonotif}`", md)
+
+	res := cv.Convert(md)
+	assert.Equal(t, "Hi {protect}{nonotif} {first} <code>{protect}{nonotif}</code>", res.HTML)
+	assert.Equal(t, tg_md2html.MessageOptions{}, res.Options)
+}
+
+func TestFillTemplateV2InvalidCode(t *testing.T) {
+	for _, x := range []struct {
+		in   string
+		text string
+	}{
+		{in: "`{x}`", text: "a`b"},
+		{in: "`{x}`", text: `C:\`},
+		{in: "```\n{x}```", text: "a```b"},
+		{in: "```\n{x}```", text: "a`"},
+		{in: "```\n{x}```", text: `C:\`},
+	} {
+		t.Run(x.text, func(t *testing.T) {
+			_, err := tg_md2html.FillTemplateV2(x.in, map[string]tg_md2html.Filling{"x": {Text: x.text}})
+			assert.ErrorIs(t, err, tg_md2html.ErrInvalidFilling)
+		})
+	}
+}